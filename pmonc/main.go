@@ -19,6 +19,9 @@ var EXEC_FAIL string = "PMON_FAIL"
 
 var connAuthToken string
 
+// rawOutput prints server output as is with the server name prefixed, for logs.
+var rawOutput bool
+
 type serverContext struct {
 	server  string
 	conn    net.Conn
@@ -103,6 +106,8 @@ func buildClientContext(servers []string) *clientContext {
 							ctx.sctxs[index].conn.Close()
 							ctx.rch <- 1
 							return
+						} else if rawOutput {
+							fmt.Printf("[%s] %s\n", servers[index], strings.TrimRight(line, "\r\n"))
 						} else if len(result) > 0 {
 							fmt.Printf("[%s]:%s\n", servers[index], result)
 						}
@@ -126,6 +131,15 @@ func execCmd(cmd string, ctx *clientContext) {
 	io.WriteString(ctx, fmt.Sprintf("system %s\r\n", cmd))
 }
 
+func tailLogs(proc string, lines int, follow bool, ctx *clientContext) {
+	cmd := fmt.Sprintf("tail %s %d", proc, lines)
+	if follow {
+		cmd += " -f"
+	}
+	defer ctx.print()
+	io.WriteString(ctx, cmd+"\r\n")
+}
+
 func updateFile(file string, ctx *clientContext) {
 	fmt.Printf("Start to update %s to servers:%v\n", file, ctx.servers)
 	f, err := os.Open(file)
@@ -156,14 +170,26 @@ func main() {
 	file := flag.String("upload", "", "upload <file>")
 	cmd := flag.String("cmd", "", "remote command execute")
 	auth := flag.String("auth", "", "connection auth token")
+	tail := flag.String("tail", "", "tail output of <process> on all servers")
+	lines := flag.Int("n", 10, "last lines printed by '-tail'")
+	follow := flag.Bool("f", false, "follow new lines for '-tail' until interrupted")
 	flag.Parse()
 	connAuthToken = *auth
-	if len(*file) == 0 && len(*cmd) == 0 {
-		fmt.Printf("'-upload' or '-cmd' need to be sepecified in args.\n")
+	if len(*file) == 0 && len(*cmd) == 0 && len(*tail) == 0 {
+		fmt.Printf("'-upload', '-cmd' or '-tail' need to be sepecified in args.\n")
 		flag.PrintDefaults()
 		return
 	}
 	ss := strings.Split(*servers, ",")
+	if len(*tail) > 0 {
+		//all servers at once, following never ends
+		rawOutput = true
+		ctx := buildClientContext(ss)
+		ctx.action = "tail"
+		tailLogs(*tail, *lines, *follow, ctx)
+		ctx.close()
+		return
+	}
 	for i := 0; i < len(ss); i += *c {
 		n := *c
 		if i+n > len(ss) {
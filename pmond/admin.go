@@ -13,7 +13,10 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -53,9 +56,10 @@ func cleanOldBackupFiles(path string) {
 			filePaths = append(filePaths, fpath)
 		}
 	}
-	if len(filePaths) > Cfg.MaxBackupFile {
+	maxBackupFile := getConfig().MaxBackupFile
+	if len(filePaths) > maxBackupFile {
 		sort.Strings(filePaths)
-		for i := 0; i < len(filePaths)-Cfg.MaxBackupFile; i++ {
+		for i := 0; i < len(filePaths)-maxBackupFile; i++ {
 			os.Remove(filePaths[i])
 		}
 	}
@@ -112,6 +116,10 @@ type commandHandler struct {
 
 var commandHandlers = make(map[string]*commandHandler)
 
+// streamingCommands may last until the client disconnects, they run in background
+// and own the connection, so they never block the only admin connection.
+var streamingCommands = map[string]bool{"tail": true, "grep": true}
+
 func help(cmd []string, c io.ReadWriteCloser) bool {
 	usage := `
 Supported Commands:
@@ -121,6 +129,14 @@ Rollback <File path> <Postfix>     Rollback updated file
 Start   <Process>                  Start process
 Restart <Process>                  WARN:restart process
 Stop    <Process>                  WARN:stop process
+Crashes  [Process] [N]             list recent N(default 10) crashes
+Crash    <ID>                      show crash report
+Audit    [N]                       show last N(default 20) audit records
+Grep     <Process> <Regex> [Since] [Until]
+                                   search current and rotated log files
+Reopen   [Process]                 reopen log files, e.g. after moved by logrotate
+Forwards                           list log forwarders with sent and dropped lines
+Tail     <Process> [N] [-f]        show last N(default 10) lines of output, -f follows new lines
 Shutdown                           WARN:Stop whole service
 Exit                               exit current connection
 `
@@ -195,7 +211,7 @@ func system(cmd []string, c io.ReadWriteCloser) bool {
 	procCmd.Env = os.Environ()
 	procCmd.Stdout = c
 	procCmd.Stderr = c
-	err := procCmd.Run()
+	err := runCommand(procCmd)
 	if nil != err {
 		io.WriteString(c, fmt.Sprintf("Failed to exec command for reason:%v\r\n", err))
 		return false
@@ -207,7 +223,7 @@ func system(cmd []string, c io.ReadWriteCloser) bool {
 func rollbackFile(args []string, c io.ReadWriteCloser) bool {
 	path := strings.TrimSpace(args[0])
 	basename := filepath.Base(path)
-	backupDir := filepath.Dir(Cfg.BackupDir + "/" + path)
+	backupDir := filepath.Dir(getConfig().BackupDir + "/" + path)
 	backupFiles, _ := ioutil.ReadDir(backupDir)
 
 	var backupPath string
@@ -244,6 +260,7 @@ func rollbackFile(args []string, c io.ReadWriteCloser) bool {
 	err = cp(path, backupPath, st.Mode())
 	if nil == err {
 		io.WriteString(c, fmt.Sprintf("Rollback file:%s from %s success.\r\n", path, backupPath))
+		notify(&event{Type: "rollback", Proc: path, Message: fmt.Sprintf("Rollback file:%s from %s", path, backupPath), routes: procRoutes(procs)})
 		for _, proc := range procs {
 			if nil != proc {
 				proc.start(tracer)
@@ -257,7 +274,7 @@ func rollbackFile(args []string, c io.ReadWriteCloser) bool {
 	}
 	for _, proc := range procs {
 		if nil != proc {
-			proc.autoRestart = true
+			proc.setAutoRestart(true)
 		}
 	}
 	return nil == err
@@ -265,7 +282,8 @@ func rollbackFile(args []string, c io.ReadWriteCloser) bool {
 
 func uploadFile(args []string, c io.ReadWriteCloser) bool {
 	path := strings.TrimSpace(args[0])
-	uploadPath := Cfg.UploadDir + "/" + path + ".new"
+	cfg := getConfig()
+	uploadPath := cfg.UploadDir + "/" + path + ".new"
 	os.MkdirAll(filepath.Dir(uploadPath), 0770)
 	defaultPerm := os.FileMode(0660)
 	if st, err := os.Lstat(path); nil == err {
@@ -274,9 +292,10 @@ func uploadFile(args []string, c io.ReadWriteCloser) bool {
 	if !recvFile(c, uploadPath, defaultPerm) {
 		return false
 	}
+	auditUpload(c, uploadPath)
 	st, err := os.Stat(path)
 	if nil == err {
-		backupPath := Cfg.BackupDir + "/" + path + st.ModTime().Format(".20060102150405")
+		backupPath := cfg.BackupDir + "/" + path + st.ModTime().Format(".20060102150405")
 		os.MkdirAll(filepath.Dir(backupPath), 0770)
 		err = cp(backupPath, path, defaultPerm)
 		if nil != err {
@@ -297,6 +316,7 @@ func uploadFile(args []string, c io.ReadWriteCloser) bool {
 	err = os.Rename(uploadPath, path)
 	if nil == err {
 		io.WriteString(c, fmt.Sprintf("Update file:%s success.\r\n", path))
+		notify(&event{Type: "deploy", Proc: path, Message: fmt.Sprintf("Update file:%s", path), routes: procRoutes(procs)})
 		if len(procs) > 0 {
 			os.Chmod(path, 0755)
 			for _, proc := range procs {
@@ -313,12 +333,101 @@ func uploadFile(args []string, c io.ReadWriteCloser) bool {
 	}
 	for _, proc := range procs {
 		if nil != proc {
-			proc.autoRestart = true
+			proc.setAutoRestart(true)
 		}
 	}
 	return nil == err
 }
 
+func listCrashes(args []string, c io.ReadWriteCloser) bool {
+	proc := ""
+	n := 10
+	for _, arg := range args {
+		if v, err := strconv.Atoi(arg); nil == err {
+			n = v
+		} else {
+			proc = arg
+		}
+	}
+	crashes := recentCrashes(getConfig().LogDir, proc, n)
+	io.WriteString(c, "ID                              Time                  PID     Cause          Signature     First Line\r\n")
+	for _, crash := range crashes {
+		fmt.Fprintf(c, "%-30s  %s  %-6d  %-13s  %-12s  %s\r\n", crash.ID, crash.Time.Format("2006-01-02 15:04:05"), crash.Pid, crash.Cause, crash.Signature, crash.First)
+	}
+	return true
+}
+
+// showCrash prints a crash report, only reports in the crash index are shown.
+func showCrash(args []string, c io.ReadWriteCloser) bool {
+	id := args[0]
+	logDir := getConfig().LogDir
+	crashIndexLock.Lock()
+	entries := loadCrashIndex(logDir)
+	crashIndexLock.Unlock()
+	found := false
+	for _, entry := range entries {
+		if entry.ID == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		fmt.Fprintf(c, "No crash report '%s' in the crash index\r\n", id)
+		return false
+	}
+	file, err := os.Open(logDir + "/" + id + ".log")
+	if nil != err {
+		io.WriteString(c, fmt.Sprintf("No crash report '%s' for reason:%v\r\n", id, err))
+		return false
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		c.Write(scanner.Bytes())
+		io.WriteString(c, "\r\n")
+	}
+	return nil == scanner.Err()
+}
+
+func listForwards(args []string, c io.ReadWriteCloser) bool {
+	io.WriteString(c, "Process                         Target                                   Sent        Dropped     Buffered\r\n")
+	for _, proc := range getProcListByName("") {
+		proc.lk.Lock()
+		forwarders := proc.forwarders
+		proc.lk.Unlock()
+		for _, f := range forwarders {
+			fmt.Fprintf(c, "%-30s  %-40s %-10d  %-10d  %d\r\n", proc.processName, f.String(), atomic.LoadUint64(&f.sent), atomic.LoadUint64(&f.dropped), len(f.records))
+		}
+	}
+	return true
+}
+
+func reopenLogs(args []string, c io.ReadWriteCloser) bool {
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+	procs := matchProcs(name)
+	if len(procs) == 0 && len(name) > 0 {
+		fmt.Fprintf(c, "No process found by name '%s'\r\n", name)
+		return false
+	}
+	for _, proc := range procs {
+		proc.reopenLogs()
+		fmt.Fprintf(c, "Reopen log files of process:%s %v\r\n", proc.processName, proc.args)
+	}
+	if len(name) == 0 {
+		reopenAudit()
+		glog.Flush()
+		if err := reopenLogFile(); nil != err {
+			fmt.Fprintf(c, "Failed to reopen log file:%s for reason:%v\r\n", logFile, err)
+			return false
+		}
+	}
+	return true
+}
+
 func shutdown(cmd []string, c io.ReadWriteCloser) bool {
 	killAll(&LogTraceWriter{c})
 	return true
@@ -328,14 +437,28 @@ type bufReaderDirectWriter struct {
 	*bufio.Reader
 	io.Writer
 	io.Closer
+	audit *auditRecord //audit record of the running command
+}
+
+// finishAudit writes the audit record of the finished command.
+func finishAudit(rec *auditRecord, success bool) {
+	rec.Result = "fail"
+	if success {
+		rec.Result = "success"
+	}
+	rec.DurationMs = int64(time.Since(rec.Time) / time.Millisecond)
+	writeAudit(rec)
 }
 
 func processAdminConn(c net.Conn) {
+	auth := getConfig().Auth
 	authed := false
-	if len(Cfg.Auth) == 0 {
+	if len(auth) == 0 {
 		authed = true
 	}
-	rw := &bufReaderDirectWriter{bufio.NewReader(c), c, c}
+	rw := &bufReaderDirectWriter{bufio.NewReader(c), c, c, nil}
+	remote := c.RemoteAddr().String()
+	identity := authIdentity(auth)
 
 	for {
 		line, _, err := rw.ReadLine()
@@ -343,10 +466,11 @@ func processAdminConn(c net.Conn) {
 			break
 		}
 		if !authed {
-			if Cfg.Auth == strings.TrimSpace(string(line)) {
+			if auth == strings.TrimSpace(string(line)) {
 				authed = true
 				continue
 			} else {
+				finishAudit(&auditRecord{Time: time.Now(), Remote: remote, Identity: "unknown", Command: "auth"}, false)
 				io.WriteString(rw, fmt.Sprintf("Connection auth failed\r\n"))
 				rw.Close()
 				return
@@ -358,20 +482,43 @@ func processAdminConn(c net.Conn) {
 			break
 		}
 		cmd := strings.Fields(string(line))
+		if len(cmd) == 0 {
+			continue
+		}
+		rec := &auditRecord{Time: time.Now(), Remote: remote, Identity: identity, Command: strings.ToLower(cmd[0]), Args: redactArgs(cmd[1:])}
 		if h, ok := commandHandlers[strings.ToLower(cmd[0])]; ok {
 			args := cmd[1:]
 			if (h.minArgs >= 0 && len(args) < h.minArgs) || (h.maxArgs >= 0 && len(args) > h.maxArgs) {
 				io.WriteString(rw, fmt.Sprintf("Invalid command args:%v for '%s'\r\n", args, cmd[0]))
+				finishAudit(rec, false)
 				continue
 			}
-			glog.Infof("Execute %v from client:%v", cmd, c.RemoteAddr())
-			if h.handler(args, rw) {
+			glog.Infof("Execute %v from client:%v", append([]string{rec.Command}, rec.Args...), c.RemoteAddr())
+			rw.audit = rec
+			if streamingCommands[strings.ToLower(cmd[0])] {
+				go func() {
+					success := h.handler(args, rw)
+					if success {
+						rw.Write(ExecSuccess)
+					} else {
+						rw.Write(ExecFail)
+					}
+					finishAudit(rec, success)
+					rw.Close()
+				}()
+				return
+			}
+			success := h.handler(args, rw)
+			if success {
 				rw.Write(ExecSuccess)
 			} else {
 				rw.Write(ExecFail)
 			}
+			finishAudit(rec, success)
+			rw.audit = nil
 		} else {
 			io.WriteString(rw, fmt.Sprintf("Error:unknown command:%v\r\n", cmd))
+			finishAudit(rec, false)
 			continue
 		}
 	}
@@ -390,4 +537,11 @@ func init() {
 	commandHandlers["restart"] = &commandHandler{restartProc, 1, 1}
 	commandHandlers["stop"] = &commandHandler{stopProc, 1, 1}
 	commandHandlers["shutdown"] = &commandHandler{shutdown, 0, 0}
+	commandHandlers["crashes"] = &commandHandler{listCrashes, 0, 2}
+	commandHandlers["crash"] = &commandHandler{showCrash, 1, 1}
+	commandHandlers["tail"] = &commandHandler{tailLog, 1, 3}
+	commandHandlers["forwards"] = &commandHandler{listForwards, 0, 0}
+	commandHandlers["reopen"] = &commandHandler{reopenLogs, 0, 1}
+	commandHandlers["grep"] = &commandHandler{grepLog, 2, 4}
+	commandHandlers["audit"] = &commandHandler{listAudit, 0, 1}
 }
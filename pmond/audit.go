@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// auditRecord is one line of the audit log, written for every admin command.
+type auditRecord struct {
+	Time       time.Time
+	Remote     string
+	Identity   string
+	Command    string
+	Args       []string `json:",omitempty"`
+	Result     string   //success or fail
+	DurationMs int64
+	FileSha256 string `json:",omitempty"` //uploaded file
+	FileSize   int64  `json:",omitempty"`
+}
+
+var auditFile *rotateFile
+var auditCfg auditConfig
+var auditLock sync.Mutex
+
+var secretName = regexp.MustCompile(`(?i)pass|secret|token|key|auth|credential`)
+var urlPassword = regexp.MustCompile(`://([^:/@\s]+):[^@/\s]+@`)
+
+// authSchemes are followed by credentials, e.g. "Authorization: Bearer <token>".
+var authSchemes = map[string]bool{"bearer": true, "basic": true, "digest": true, "negotiate": true}
+
+// redactArgs hides values of secret looking args: name=value, name: value headers, credentials after
+// an auth scheme, -flag value, mysql like -p<password>, curl like -u user:password, and passwords in URLs.
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	redactNext := false
+	userNext := false
+	for i, arg := range args {
+		idx := strings.Index(arg, "=")
+		colon := strings.Index(arg, ":")
+		switch {
+		case redactNext && authSchemes[strings.ToLower(arg)]:
+			//the scheme itself is kept, the credentials after it are not
+			redacted[i] = arg
+		case redactNext:
+			redacted[i] = "***"
+			redactNext = false
+		case userNext && colon >= 0:
+			redacted[i] = arg[:colon+1] + "***"
+			userNext = false
+		case authSchemes[strings.ToLower(arg)]:
+			redacted[i] = arg
+			redactNext = true
+		case idx > 0 && secretName.MatchString(arg[:idx]):
+			redacted[i] = arg[:idx+1] + "***"
+		case colon > 0 && !strings.Contains(arg, "://") && secretName.MatchString(arg[:colon]):
+			//header like Authorization: <credentials>, or X-Api-Key:<key> in one arg
+			redacted[i] = arg[:colon+1]
+			if value := arg[colon+1:]; len(value) == 0 || authSchemes[strings.ToLower(value)] {
+				redacted[i] += value
+				redactNext = true
+			} else {
+				redacted[i] += "***"
+			}
+		case arg == "-p":
+			redacted[i] = arg
+			redactNext = true
+		case strings.HasPrefix(arg, "-p") && !strings.HasPrefix(strings.ToLower(arg), "-pass"):
+			redacted[i] = "-p***"
+		case strings.HasPrefix(arg, "-") && secretName.MatchString(arg):
+			redacted[i] = arg
+			redactNext = true
+		case arg == "-u" || arg == "--user":
+			redacted[i] = arg
+			userNext = true
+		default:
+			userNext = false
+			redacted[i] = urlPassword.ReplaceAllString(arg, "://$1:***@")
+		}
+	}
+	return redacted
+}
+
+// authIdentity identifies the auth token without logging it.
+func authIdentity(token string) string {
+	if len(token) == 0 {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:4])
+}
+
+// setupAudit (re)opens the audit log on config reload.
+func setupAudit(cfg *procMonConfig) {
+	acfg := cfg.Audit
+	if len(acfg.File) == 0 {
+		acfg.File = cfg.LogDir + "/audit.log"
+	}
+	if acfg.MaxSize == 0 {
+		acfg.MaxSize = 100
+	}
+	if acfg.MaxBackups == 0 {
+		acfg.MaxBackups = 10
+	}
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if nil != auditFile && reflect.DeepEqual(auditCfg, acfg) {
+		return
+	}
+	if nil != auditFile {
+		auditFile.Close()
+		auditFile = nil
+	}
+	auditCfg = acfg
+	rfile, err := openRotateFile(acfg.File, &acfg.logConfig)
+	if nil != err {
+		glog.Errorf("Failed to open audit log for reason:%v", err)
+		return
+	}
+	auditFile = rfile
+}
+
+func reopenAudit() {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if nil != auditFile {
+		if err := auditFile.reopen(); nil != err {
+			glog.Errorf("Failed to reopen audit log for reason:%v", err)
+		}
+	}
+}
+
+func writeAudit(rec *auditRecord) {
+	data, _ := json.Marshal(rec)
+	data = append(data, '\n')
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if nil == auditFile {
+		return
+	}
+	if _, err := auditFile.Write(data); nil != err {
+		glog.Errorf("Failed to write audit log for reason:%v", err)
+	}
+}
+
+// auditUpload records hash and size of the uploaded file in the audit record of the connection.
+func auditUpload(c io.ReadWriteCloser, path string) {
+	rw, ok := c.(*bufReaderDirectWriter)
+	if !ok || nil == rw.audit {
+		return
+	}
+	f, err := os.Open(path)
+	if nil != err {
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if nil != err {
+		return
+	}
+	rw.audit.FileSha256 = hex.EncodeToString(h.Sum(nil))
+	rw.audit.FileSize = n
+}
+
+func listAudit(args []string, c io.ReadWriteCloser) bool {
+	n := 20
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if nil != err || v <= 0 {
+			fmt.Fprintf(c, "Invalid audit record count '%s'\r\n", args[0])
+			return false
+		}
+		n = v
+	}
+	auditLock.Lock()
+	file := auditCfg.File
+	auditLock.Unlock()
+	lines, err := tailFile(file, n)
+	if nil != err {
+		fmt.Fprintf(c, "Failed to read audit log for reason:%v\r\n", err)
+		return false
+	}
+	io.WriteString(c, "Time                 Remote                 Identity        Result   Duration  Command\r\n")
+	for _, line := range lines {
+		var rec auditRecord
+		if nil != json.Unmarshal([]byte(line), &rec) {
+			continue
+		}
+		command := strings.TrimSpace(rec.Command + " " + strings.Join(rec.Args, " "))
+		if len(rec.FileSha256) > 0 {
+			command += fmt.Sprintf(" (size:%d sha256:%s)", rec.FileSize, rec.FileSha256)
+		}
+		fmt.Fprintf(c, "%s  %-21s  %-14s  %-7s  %6dms  %s\r\n", rec.Time.Format("2006-01-02 15:04:05"), rec.Remote, rec.Identity, rec.Result, rec.DurationMs, command)
+	}
+	return true
+}
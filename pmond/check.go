@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// checkTarget describes the running process being checked.
+type checkTarget struct {
+	pid  int
+	name string
+}
+
+type checkFunc func(cfg *checkConfig, target *checkTarget) error
+
+var checkers = make(map[string]checkFunc)
+
+func (cfg *checkConfig) timeout() time.Duration {
+	return time.Duration(cfg.Timeout) * time.Second
+}
+
+func tcpCheck(cfg *checkConfig, target *checkTarget) error {
+	return connCheck("tcp", cfg)
+}
+
+func unixCheck(cfg *checkConfig, target *checkTarget) error {
+	return connCheck("unix", cfg)
+}
+
+// connCheck connects to Addr, and if Send is set writes it and reads until the reply matches the Expect regex.
+func connCheck(network string, cfg *checkConfig) error {
+	c, err := net.DialTimeout(network, cfg.Addr, cfg.timeout())
+	if nil != err {
+		return err
+	}
+	defer c.Close()
+	if len(cfg.Send) == 0 && len(cfg.Expect) == 0 {
+		return nil
+	}
+	readTimeout := time.Duration(cfg.ReadTimeout) * time.Second
+	if readTimeout <= 0 {
+		readTimeout = cfg.timeout()
+	}
+	if len(cfg.Send) > 0 {
+		send, err := unescape(cfg.Send)
+		if nil != err {
+			return fmt.Errorf("Invalid Send %q:%v", cfg.Send, err)
+		}
+		c.SetWriteDeadline(time.Now().Add(cfg.timeout()))
+		if _, err = c.Write(send); nil != err {
+			return err
+		}
+	}
+	if len(cfg.Expect) == 0 {
+		return nil
+	}
+	re, err := regexp.Compile(cfg.Expect)
+	if nil != err {
+		return fmt.Errorf("Invalid Expect regex '%s':%v", cfg.Expect, err)
+	}
+	c.SetReadDeadline(time.Now().Add(readTimeout))
+	var recv []byte
+	buf := make([]byte, 4096)
+	for len(recv) < 64*1024 {
+		n, err := c.Read(buf)
+		recv = append(recv, buf[:n]...)
+		if re.Match(recv) {
+			return nil
+		}
+		if nil != err {
+			return fmt.Errorf("expect '%s' but received %q, err:%v", cfg.Expect, truncate(recv, 256), err)
+		}
+	}
+	return fmt.Errorf("expect '%s' but received %q", cfg.Expect, truncate(recv, 256))
+}
+
+// unescape decodes go style escapes like \r\n, \x00 and \u00ff in s.
+func unescape(s string) ([]byte, error) {
+	var buf []byte
+	for len(s) > 0 {
+		v, multibyte, tail, err := strconv.UnquoteChar(s, 0)
+		if nil != err {
+			return nil, err
+		}
+		if multibyte {
+			buf = append(buf, string(v)...)
+		} else {
+			buf = append(buf, byte(v))
+		}
+		s = tail
+	}
+	return buf, nil
+}
+
+// fileCheck fails if the heartbeat File was not modified within MaxAge seconds.
+func fileCheck(cfg *checkConfig, target *checkTarget) error {
+	st, err := os.Stat(cfg.File)
+	if nil != err {
+		return err
+	}
+	age := time.Since(st.ModTime())
+	if age > time.Duration(cfg.MaxAge)*time.Second {
+		return fmt.Errorf("heartbeat file %s not modified for %v, max age %ds", cfg.File, age.Truncate(time.Second), cfg.MaxAge)
+	}
+	return nil
+}
+
+func httpCheck(cfg *checkConfig, target *checkTarget) error {
+	scheme := cfg.kind()
+	path := cfg.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	method := strings.ToUpper(cfg.Method)
+	if len(method) == 0 {
+		method = "GET"
+	}
+	url := scheme + "://" + cfg.Addr + path
+	req, err := http.NewRequest(method, url, nil)
+	if nil != err {
+		return err
+	}
+	for k, v := range cfg.Headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+		} else {
+			req.Header.Set(k, v)
+		}
+	}
+	tlsCfg, err := cfg.tlsConfig()
+	if nil != err {
+		return err
+	}
+	client := &http.Client{
+		Timeout: cfg.timeout(),
+		Transport: &http.Transport{
+			TLSClientConfig:   tlsCfg,
+			DisableKeepAlives: true,
+		},
+	}
+	res, err := client.Do(req)
+	if nil != err {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if nil != err {
+		return fmt.Errorf("%s %s read body failed:%v", method, url, err)
+	}
+	if cfg.ExpectStatus > 0 {
+		if res.StatusCode != cfg.ExpectStatus {
+			return fmt.Errorf("%s %s got status %d, expect %d", method, url, res.StatusCode, cfg.ExpectStatus)
+		}
+	} else if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%s %s got status %d, expect 2xx", method, url, res.StatusCode)
+	}
+	if len(cfg.ExpectBody) > 0 {
+		re, err := regexp.Compile(cfg.ExpectBody)
+		if nil != err {
+			return fmt.Errorf("Invalid ExpectBody regex '%s':%v", cfg.ExpectBody, err)
+		}
+		if !re.Match(body) {
+			return fmt.Errorf("%s %s body %q not match '%s'", method, url, truncate(body, 256), cfg.ExpectBody)
+		}
+	}
+	return nil
+}
+
+// commandCheck runs the probe command, PID and NAME of the checked process are passed in the environment.
+func commandCheck(cfg *checkConfig, target *checkTarget) error {
+	if len(cfg.Command) == 0 {
+		return fmt.Errorf("Empty check command")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout())
+	defer cancel()
+	cmd := probeCommand(ctx, cfg.Command)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("PID=%d", target.pid), "NAME="+target.name)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := runCommand(cmd)
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timeout after %v", cfg.timeout())
+	}
+	if nil != err {
+		return fmt.Errorf("command %v failed:%v, output:%q", cfg.Command, err, truncate(output.Bytes(), 4096))
+	}
+	return nil
+}
+
+// runActionCommand runs the command action of an unhealthy process and logs its output.
+func runActionCommand(cfg *checkConfig, target *checkTarget, checkErr error) {
+	if len(cfg.ActionCommand) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cmd := probeCommand(ctx, cfg.ActionCommand)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("PID=%d", target.pid), "NAME="+target.name, fmt.Sprintf("CHECK_ERROR=%v", checkErr))
+	output, err := combinedOutput(cmd)
+	if nil != err {
+		glog.Errorf("Check action command %v for process:%s failed:%v, output:%q", cfg.ActionCommand, target.name, err, truncate(output, 4096))
+	} else {
+		glog.Infof("Check action command %v for process:%s output:%q", cfg.ActionCommand, target.name, truncate(output, 4096))
+	}
+}
+
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGABRT": syscall.SIGABRT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, ok := signals[name]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("Unsupported signal '%s'", name)
+}
+
+// probeCommand creates a command in its own process group, the whole group is killed once ctx is done.
+func probeCommand(ctx context.Context, args []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+	return cmd
+}
+
+func truncate(p []byte, n int) []byte {
+	if len(p) > n {
+		return p[:n]
+	}
+	return p
+}
+
+// grpcCheck calls the standard grpc.health.v1 Health/Check, only SERVING is healthy.
+func grpcCheck(cfg *checkConfig, target *checkTarget) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout())
+	defer cancel()
+	creds := insecure.NewCredentials()
+	if cfg.TLS {
+		tlsCfg, err := cfg.tlsConfig()
+		if nil != err {
+			return err
+		}
+		creds = credentials.NewTLS(tlsCfg)
+	}
+	conn, err := grpc.NewClient(cfg.Addr, grpc.WithTransportCredentials(creds))
+	if nil != err {
+		return err
+	}
+	defer conn.Close()
+	res, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: cfg.Service})
+	if nil != err {
+		return fmt.Errorf("grpc health check service '%s' failed:%v", cfg.Service, err)
+	}
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("grpc health check service '%s' got status %v", cfg.Service, res.Status)
+	}
+	return nil
+}
+
+func (cfg *checkConfig) tlsConfig() (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		InsecureSkipVerify: cfg.Insecure,
+		ServerName:         cfg.ServerName,
+	}
+	if len(cfg.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if nil != err {
+			return nil, err
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in CAFile:%s", cfg.CAFile)
+		}
+	}
+	if len(cfg.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if nil != err {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+func (cfg *checkConfig) enabled() bool {
+	switch cfg.kind() {
+	case "command":
+		return len(cfg.Command) > 0
+	case "file":
+		return len(cfg.File) > 0 && cfg.MaxAge > 0
+	}
+	return len(cfg.Addr) > 0
+}
+
+func (cfg *checkConfig) kind() string {
+	if len(cfg.Type) == 0 {
+		return "tcp"
+	}
+	return strings.ToLower(cfg.Type)
+}
+
+// runCheck executes the configured check once, a nil error means the process is healthy.
+func runCheck(cfg *checkConfig, target *checkTarget) error {
+	checker, ok := checkers[cfg.kind()]
+	if !ok {
+		return fmt.Errorf("Unknown check type '%s'", cfg.Type)
+	}
+	return checker(cfg, target)
+}
+
+func init() {
+	checkers["tcp"] = tcpCheck
+	checkers["http"] = httpCheck
+	checkers["https"] = httpCheck
+	checkers["command"] = commandCheck
+	checkers["unix"] = unixCheck
+	checkers["file"] = fileCheck
+	checkers["grpc"] = grpcCheck
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func startHealthServer(t *testing.T) (*health.Server, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return hs, lis.Addr().String()
+}
+
+func TestGrpcCheck(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("app", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("down", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	tests := []struct {
+		service string
+		healthy bool
+	}{
+		{"", true},
+		{"app", true},
+		{"down", false},
+		{"unknown", false},
+	}
+	for _, tt := range tests {
+		err := grpcCheck(&checkConfig{Addr: addr, Timeout: 2, Service: tt.service}, &checkTarget{})
+		if tt.healthy && nil != err {
+			t.Errorf("service '%s' expected healthy, got %v", tt.service, err)
+		}
+		if !tt.healthy && nil == err {
+			t.Errorf("service '%s' expected unhealthy", tt.service)
+		}
+	}
+
+	hs.SetServingStatus("app", healthpb.HealthCheckResponse_NOT_SERVING)
+	if err := grpcCheck(&checkConfig{Addr: addr, Timeout: 2, Service: "app"}, &checkTarget{}); nil == err {
+		t.Errorf("service 'app' expected unhealthy after NOT_SERVING")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// coreLimitLock is held by every child start, so no child inherits RLIMIT_CORE raised for another one.
+var coreLimitLock sync.Mutex
+
+// startCommand starts cmd with the RLIMIT_CORE of pmond, it must be used instead of cmd.Start.
+func startCommand(cmd *exec.Cmd) error {
+	coreLimitLock.Lock()
+	defer coreLimitLock.Unlock()
+	return cmd.Start()
+}
+
+// runCommand is cmd.Run through startCommand.
+func runCommand(cmd *exec.Cmd) error {
+	if err := startCommand(cmd); nil != err {
+		return err
+	}
+	return cmd.Wait()
+}
+
+// combinedOutput is cmd.CombinedOutput through startCommand.
+func combinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := runCommand(cmd)
+	return output.Bytes(), err
+}
+
+// startWithCoreLimit starts cmd with the soft RLIMIT_CORE raised to the hard limit,
+// the child inherits the limit of pmond at fork time, so pmond's own limit is restored afterwards.
+func startWithCoreLimit(cmd *exec.Cmd) error {
+	coreLimitLock.Lock()
+	defer coreLimitLock.Unlock()
+	var old syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &old); nil != err {
+		glog.Errorf("Failed to get RLIMIT_CORE for reason:%v", err)
+		return cmd.Start()
+	}
+	raised := syscall.Rlimit{Cur: old.Max, Max: old.Max}
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &raised); nil != err {
+		glog.Errorf("Failed to raise RLIMIT_CORE for reason:%v", err)
+		return cmd.Start()
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_CORE, &old)
+	return cmd.Start()
+}
+
+// corePattern returns a glob matching the core file of the process by the kernel core pattern.
+func corePattern(cfg *coreConfig, exe string, pid int, sig syscall.Signal) (string, error) {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/core_pattern")
+	if nil != err {
+		return "", err
+	}
+	pattern := strings.TrimSpace(string(data))
+	if strings.HasPrefix(pattern, "|") {
+		return "", fmt.Errorf("core dumps are piped to '%s'", pattern[1:])
+	}
+	usesPid, _ := ioutil.ReadFile("/proc/sys/kernel/core_uses_pid")
+	if strings.TrimSpace(string(usesPid)) == "1" && !strings.Contains(pattern, "%p") {
+		pattern += ".%p"
+	}
+	comm := filepath.Base(exe)
+	if len(comm) > 15 {
+		comm = comm[:15]
+	}
+	hostname, _ := os.Hostname()
+	var glob strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			glob.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case '%':
+			glob.WriteByte('%')
+		case 'p', 'P', 'i', 'I':
+			glob.WriteString(strconv.Itoa(pid))
+		case 'e':
+			glob.WriteString(comm)
+		case 'h':
+			glob.WriteString(hostname)
+		case 's':
+			glob.WriteString(strconv.Itoa(int(sig)))
+		case 'u':
+			glob.WriteString(strconv.Itoa(os.Getuid()))
+		case 'g':
+			glob.WriteString(strconv.Itoa(os.Getgid()))
+		default:
+			glob.WriteByte('*')
+		}
+	}
+	path := glob.String()
+	if !filepath.IsAbs(path) {
+		//relative pattern is relative to the working directory of the process, Dir or the same as pmond
+		dir := cfg.Dir
+		if len(dir) == 0 {
+			dir, _ = os.Getwd()
+		}
+		path = filepath.Join(dir, path)
+	}
+	return path, nil
+}
+
+// collectCore moves the core file of the crashed process next to its crash report in dir,
+// and returns the new path of the core file.
+func collectCore(cfg *coreConfig, dir string, exe string, pid int, sig syscall.Signal, since time.Time) (string, error) {
+	pattern, err := corePattern(cfg, exe, pid, sig)
+	if nil != err {
+		return "", err
+	}
+	matches, _ := filepath.Glob(pattern)
+	var core string
+	var coreTime time.Time
+	for _, match := range matches {
+		st, err := os.Stat(match)
+		if nil != err || !st.Mode().IsRegular() || st.ModTime().Before(since) {
+			continue
+		}
+		if st.ModTime().After(coreTime) {
+			core, coreTime = match, st.ModTime()
+		}
+	}
+	if len(core) == 0 {
+		return "", fmt.Errorf("No core file matches '%s'", pattern)
+	}
+	dest := fmt.Sprintf("%s/%s-core-%d", dir, filepath.Base(exe), pid)
+	if cfg.Compress {
+		dest += ".gz"
+		err = gzipFile(core, dest)
+	} else {
+		err = moveFile(core, dest)
+	}
+	if nil != err {
+		return "", err
+	}
+	cleanOldCores(cfg, dir, filepath.Base(exe))
+	return dest, nil
+}
+
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); nil == err {
+		return nil
+	}
+	//rename fails across file systems
+	st, err := os.Stat(src)
+	if nil != err {
+		return err
+	}
+	if err = cp(dst, src, st.Mode()); nil != err {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func gzipFile(src, dst string) error {
+	s, err := os.Open(src)
+	if nil != err {
+		return err
+	}
+	defer s.Close()
+	d, err := os.Create(dst)
+	if nil != err {
+		return err
+	}
+	zw := gzip.NewWriter(d)
+	_, err = io.Copy(zw, s)
+	if nil == err {
+		err = zw.Close()
+	}
+	if cerr := d.Close(); nil == err {
+		err = cerr
+	}
+	if nil != err {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// cleanOldCores keeps at most MaxCount core files and MaxSize MB of cores of the process, newest first.
+func cleanOldCores(cfg *coreConfig, dir string, name string) {
+	files, _ := ioutil.ReadDir(dir)
+	var cores []os.FileInfo
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), name+"-core-") {
+			cores = append(cores, f)
+		}
+	}
+	sort.Slice(cores, func(i, j int) bool {
+		return cores[i].ModTime().After(cores[j].ModTime())
+	})
+	var total int64
+	for i, f := range cores {
+		total += f.Size()
+		if (cfg.MaxCount > 0 && i >= cfg.MaxCount) || (cfg.MaxSize > 0 && total > int64(cfg.MaxSize)*1024*1024) {
+			glog.Infof("Remove old core file:%s", f.Name())
+			os.Remove(dir + "/" + f.Name())
+		}
+	}
+}
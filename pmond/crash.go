@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// crashReport describes an unexpected exit of a monitored process.
+type crashReport struct {
+	Proc        string
+	Args        []string
+	Host        string
+	Pid         int
+	Time        time.Time
+	Cause       string //exited, health check, watchdog, oom or killed
+	Reason      string `json:",omitempty"`
+	ExitCode    int
+	Signal      string `json:",omitempty"`
+	CoreDumped  bool
+	CoreFile    string `json:",omitempty"`
+	Uptime      string
+	Restarts    int
+	Crash       string   `json:",omitempty"`
+	Signature   string   `json:",omitempty"`
+	Occurrences int      `json:",omitempty"`
+	Frames      []string `json:",omitempty"`
+	Output      []string `json:",omitempty"`
+}
+
+// lineRing keeps the last lines of process output in memory.
+type lineRing struct {
+	lines []string
+	next  int
+	full  bool
+}
+
+func newLineRing(size int) *lineRing {
+	return &lineRing{lines: make([]string, size)}
+}
+
+func (ring *lineRing) add(line string) {
+	if len(ring.lines) == 0 {
+		return
+	}
+	ring.lines[ring.next] = line
+	ring.next = (ring.next + 1) % len(ring.lines)
+	if ring.next == 0 {
+		ring.full = true
+	}
+}
+
+// last returns at most n latest lines, n <= 0 means all kept lines.
+func (ring *lineRing) last(n int) []string {
+	var lines []string
+	if ring.full {
+		lines = append(lines, ring.lines[ring.next:]...)
+	}
+	lines = append(lines, ring.lines[:ring.next]...)
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// exitCause returns why the process exited, or empty if it was stopped on purpose.
+func (mproc *monitorProc) exitCause(status syscall.WaitStatus) string {
+	switch {
+	case mproc.forceKilled:
+		return "watchdog"
+	case mproc.stopReason == "health check":
+		return "health check"
+	case len(mproc.stopReason) > 0:
+		return ""
+	case status.Signaled() && status.Signal() == syscall.SIGKILL:
+		//nobody in pmond sent the SIGKILL, it is the OOM killer only if the oom_kill counter grew
+		if len(mproc.oomFile) > 0 && oomKillCount(mproc.oomFile) > mproc.oomKills {
+			return "oom"
+		}
+		return "killed"
+	}
+	return "exited"
+}
+
+// oomKillFile returns the file counting OOM kills of the memory cgroup of pid:
+// memory.events of cgroup v2, memory.oom_control of cgroup v1, or the system wide /proc/vmstat.
+func oomKillFile(pid int) string {
+	data, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	var candidates []string
+	for _, line := range strings.Split(string(data), "\n") {
+		//hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && len(fields[1]) == 0 {
+			candidates = append(candidates, filepath.Join("/sys/fs/cgroup", fields[2], "memory.events"),
+				filepath.Join("/sys/fs/cgroup/unified", fields[2], "memory.events"))
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller == "memory" {
+				//the cgroup path is not visible in a container without cgroup namespace
+				candidates = append(candidates, filepath.Join("/sys/fs/cgroup/memory", fields[2], "memory.oom_control"),
+					"/sys/fs/cgroup/memory/memory.oom_control")
+			}
+		}
+	}
+	for _, file := range append(candidates, "/proc/vmstat") {
+		if oomKillCount(file) >= 0 {
+			return file
+		}
+	}
+	return ""
+}
+
+// oomKillCount returns the oom_kill counter in the file, -1 if not found.
+func oomKillCount(file string) int64 {
+	data, err := ioutil.ReadFile(file)
+	if nil != err {
+		return -1
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			if n, err := strconv.ParseInt(fields[1], 10, 64); nil == err {
+				return n
+			}
+		}
+	}
+	return -1
+}
+
+// newCrashReport builds the report of an exited process, it returns nil if the exit was expected.
+func (mproc *monitorProc) newCrashReport(cmd *exec.Cmd, output *ProcOutput) *crashReport {
+	status, _ := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	cause := mproc.exitCause(status)
+	if len(cause) == 0 {
+		return nil
+	}
+	report := &crashReport{
+		Proc:       mproc.processName,
+		Args:       mproc.args,
+		Pid:        cmd.Process.Pid,
+		Time:       time.Now(),
+		Cause:      cause,
+		Reason:     mproc.stopDetail,
+		ExitCode:   status.ExitStatus(),
+		CoreDumped: status.CoreDump(),
+		Uptime:     time.Since(mproc.startTime).Round(time.Second).String(),
+		Restarts:   mproc.restarts,
+	}
+	report.Host, _ = os.Hostname()
+	if status.Signaled() {
+		report.Signal = status.Signal().String()
+	}
+	output.lk.Lock()
+	report.Crash = output.crashContent.String()
+	report.Output = output.tail.last(mproc.cfg.Crash.TailLines)
+	output.lk.Unlock()
+	report.Signature, report.Frames = crashSignature(report.Crash)
+	return report
+}
+
+func (report *crashReport) text() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Process:     %s %s\n", report.Proc, strings.Join(report.Args, " "))
+	fmt.Fprintf(&buf, "Host:        %s\n", report.Host)
+	fmt.Fprintf(&buf, "Pid:         %d\n", report.Pid)
+	fmt.Fprintf(&buf, "Time:        %s\n", report.Time.Format(time.RFC3339))
+	fmt.Fprintf(&buf, "Cause:       %s\n", report.Cause)
+	if len(report.Reason) > 0 {
+		fmt.Fprintf(&buf, "Reason:      %s\n", report.Reason)
+	}
+	fmt.Fprintf(&buf, "Exit code:   %d\n", report.ExitCode)
+	if len(report.Signal) > 0 {
+		fmt.Fprintf(&buf, "Signal:      %s\n", report.Signal)
+	}
+	fmt.Fprintf(&buf, "Core dumped: %v\n", report.CoreDumped)
+	if len(report.CoreFile) > 0 {
+		fmt.Fprintf(&buf, "Core file:   %s\n", report.CoreFile)
+	}
+	fmt.Fprintf(&buf, "Uptime:      %s\n", report.Uptime)
+	fmt.Fprintf(&buf, "Restarts:    %d\n", report.Restarts)
+	if len(report.Signature) > 0 {
+		fmt.Fprintf(&buf, "Signature:   %s (%d occurrences)\n", report.Signature, report.Occurrences)
+	}
+	if len(report.Frames) > 0 {
+		fmt.Fprintf(&buf, "\n=== Panicking goroutine\n")
+		for _, frame := range report.Frames {
+			fmt.Fprintf(&buf, "%s\n", frame)
+		}
+	}
+	if len(report.Crash) > 0 {
+		fmt.Fprintf(&buf, "\n=== Crash\n%s", report.Crash)
+	}
+	if len(report.Output) > 0 {
+		fmt.Fprintf(&buf, "\n=== Last %d lines of output\n", len(report.Output))
+		for _, line := range report.Output {
+			buf.WriteString(line)
+		}
+	}
+	return buf.Bytes()
+}
+
+// runCrashCommand runs Crash.Command with the crash passed in PMON_* environment variables,
+// the crash content is never put into the command line.
+func runCrashCommand(cfg *crashConfig, report *crashReport, reportFile string) {
+	crashFile, err := ioutil.TempFile("", "pmon-crash-")
+	if nil != err {
+		glog.Errorf("Failed to create crash file for reason:%v", err)
+		return
+	}
+	defer os.Remove(crashFile.Name())
+	crashFile.WriteString(report.Crash)
+	crashFile.Close()
+
+	timeout := time.Duration(cfg.CommandTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := probeCommand(ctx, cfg.Command)
+	cmd.Env = append(os.Environ(),
+		"PMON_PROC="+filepath.Base(report.Proc),
+		fmt.Sprintf("PMON_PID=%d", report.Pid),
+		fmt.Sprintf("PMON_EXIT_CODE=%d", report.ExitCode),
+		"PMON_SIGNAL="+report.Signal,
+		"PMON_CAUSE="+report.Cause,
+		"PMON_SIGNATURE="+report.Signature,
+		"PMON_CRASH_FILE="+crashFile.Name(),
+		"PMON_REPORT_FILE="+reportFile,
+		"PMON_HOST="+report.Host)
+	output, err := combinedOutput(cmd)
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timeout after %v", timeout)
+	}
+	if nil != err {
+		glog.Errorf("Crash command %v for process:%s failed:%v, output:%q", cfg.Command, report.Proc, err, truncate(output, 4096))
+	} else {
+		glog.Infof("Crash command %v for process:%s output:%q", cfg.Command, report.Proc, truncate(output, 4096))
+	}
+}
+
+// save writes the report as <name>-crash-<pid>.log and <name>-crash-<pid>.json into dir.
+func (report *crashReport) save(dir string) string {
+	path := fmt.Sprintf("%s/%s-crash-%d", dir, filepath.Base(report.Proc), report.Pid)
+	if err := ioutil.WriteFile(path+".log", report.text(), 0666); nil != err {
+		glog.Errorf("Failed to write crash report for reason:%v", err)
+	}
+	data, _ := json.MarshalIndent(report, "", "  ")
+	if err := ioutil.WriteFile(path+".json", data, 0666); nil != err {
+		glog.Errorf("Failed to write crash report for reason:%v", err)
+	}
+	return path + ".log"
+}
+
+// crashEntry is a line of the crash index, ID is the file name of the report without extension.
+type crashEntry struct {
+	ID        string
+	Proc      string
+	Pid       int
+	Time      time.Time
+	Cause     string
+	Signature string `json:",omitempty"`
+	First     string
+}
+
+var crashIndexLock sync.Mutex
+
+func crashIndexPath(logDir string) string {
+	return logDir + "/crashes.idx"
+}
+
+func loadCrashIndex(logDir string) []crashEntry {
+	var entries []crashEntry
+	data, err := ioutil.ReadFile(crashIndexPath(logDir))
+	if nil != err {
+		return entries
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var entry crashEntry
+		if len(line) > 0 && nil == json.Unmarshal(line, &entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func saveCrashIndex(logDir string, entries []crashEntry) error {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		data, _ := json.Marshal(&entry)
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	tmp := crashIndexPath(logDir) + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0666); nil != err {
+		return err
+	}
+	return os.Rename(tmp, crashIndexPath(logDir))
+}
+
+// indexCrash adds the report to the crash index in LogDir, and removes reports beyond MaxCrashReports or older than MaxCrashAge days.
+func indexCrash(cfg *procMonConfig, report *crashReport, reportFile string) {
+	first := report.Reason
+	if len(report.Crash) > 0 {
+		first = strings.SplitN(report.Crash, "\n", 2)[0]
+	}
+	if len(first) == 0 {
+		first = fmt.Sprintf("exit code:%d %s", report.ExitCode, report.Signal)
+	}
+	entry := crashEntry{
+		ID:        strings.TrimSuffix(filepath.Base(reportFile), ".log"),
+		Proc:      report.Proc,
+		Pid:       report.Pid,
+		Time:      report.Time,
+		Cause:     report.Cause,
+		Signature: report.Signature,
+		First:     first,
+	}
+	crashIndexLock.Lock()
+	defer crashIndexLock.Unlock()
+	var entries []crashEntry
+	for _, e := range loadCrashIndex(cfg.LogDir) {
+		//the report of a reused pid was overwritten
+		if e.ID != entry.ID {
+			entries = append(entries, e)
+		}
+	}
+	entries = append(entries, entry)
+	expire := time.Now().AddDate(0, 0, -cfg.MaxCrashAge)
+	start := 0
+	for start < len(entries) && (len(entries)-start > cfg.MaxCrashReports || entries[start].Time.Before(expire)) {
+		os.Remove(cfg.LogDir + "/" + entries[start].ID + ".log")
+		os.Remove(cfg.LogDir + "/" + entries[start].ID + ".json")
+		start++
+	}
+	if err := saveCrashIndex(cfg.LogDir, entries[start:]); nil != err {
+		glog.Errorf("Failed to save crash index for reason:%v", err)
+	}
+}
+
+// recentCrashes returns at most n latest crashes of processes with name prefix proc, newest first.
+func recentCrashes(logDir string, proc string, n int) []crashEntry {
+	crashIndexLock.Lock()
+	entries := loadCrashIndex(logDir)
+	crashIndexLock.Unlock()
+	var crashes []crashEntry
+	for i := len(entries) - 1; i >= 0 && len(crashes) < n; i-- {
+		if strings.HasPrefix(entries[i].Proc, proc) || strings.HasPrefix(filepath.Base(entries[i].Proc), proc) {
+			crashes = append(crashes, entries[i])
+		}
+	}
+	return crashes
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+func (cfg *diagConfig) enabled() bool {
+	return len(cfg.Signal) > 0 || len(cfg.PprofURL) > 0
+}
+
+// diagnose collects the configured OnUnhealthy diagnostics of a hung process before it is killed,
+// the result is saved as <name>-diag-<pid>.log in LogDir.
+func (mproc *monitorProc) diagnose(cfg *diagConfig, target *checkTarget, output *ProcOutput, reason error) {
+	var report bytes.Buffer
+	fmt.Fprintf(&report, "Process:%s pid:%d unhealthy at %s for reason:%v\n", mproc.processName, target.pid, time.Now().Format(time.RFC3339), reason)
+	if len(cfg.PprofURL) > 0 {
+		fmt.Fprintf(&report, "\n=== GET %s\n", cfg.PprofURL)
+		client := &http.Client{Timeout: 10 * time.Second}
+		res, err := client.Get(cfg.PprofURL)
+		if nil != err {
+			fmt.Fprintf(&report, "Failed to fetch:%v\n", err)
+		} else {
+			io.Copy(&report, io.LimitReader(res.Body, 16*1024*1024))
+			res.Body.Close()
+		}
+	}
+	if len(cfg.Signal) > 0 {
+		sig, err := parseSignal(cfg.Signal)
+		fmt.Fprintf(&report, "\n=== Output after %s\n", cfg.Signal)
+		if nil != err {
+			fmt.Fprintf(&report, "%v\n", err)
+		} else if nil != output {
+			wait := time.Duration(cfg.Wait) * time.Second
+			if wait <= 0 {
+				wait = 2 * time.Second
+			}
+			var captured bytes.Buffer
+			output.setTee(&captured)
+			mproc.signal(target.pid, sig)
+			time.Sleep(wait)
+			output.setTee(nil)
+			report.Write(captured.Bytes())
+		}
+	}
+	diagFileName := fmt.Sprintf("%s/%s-diag-%d.log", getConfig().LogDir, filepath.Base(mproc.processName), target.pid)
+	if err := ioutil.WriteFile(diagFileName, report.Bytes(), 0666); nil != err {
+		glog.Errorf("Failed to save diagnostics of process:%s for reason:%v", mproc.processName, err)
+	} else {
+		glog.Infof("Saved diagnostics of process:%s to %s", mproc.processName, diagFileName)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// logRecord is one output line of a process.
+type logRecord struct {
+	time   time.Time
+	stream string
+	pid    int
+	msg    []byte
+}
+
+// logForwarder sends output lines of a process to a log collector in background.
+// Lines are buffered up to BufferSize, then dropped, so a slow collector never blocks the process.
+type logForwarder struct {
+	cfg     forwardConfig
+	proc    string
+	host    string
+	records chan *logRecord
+	quit    chan bool
+	conn    net.Conn
+	syslog  *syslogWriter
+	sent    uint64
+	dropped uint64
+}
+
+func newLogForwarder(cfg forwardConfig, proc string) (*logForwarder, error) {
+	cfg.Type = strings.ToLower(cfg.Type)
+	switch cfg.Type {
+	case "syslog":
+		if len(cfg.Tag) == 0 {
+			cfg.Tag = proc
+		}
+	case "json", "fluent":
+		if len(cfg.Network) == 0 {
+			cfg.Network = "tcp"
+		}
+		if len(cfg.Addr) == 0 {
+			return nil, fmt.Errorf("Empty Addr of %s log forwarder", cfg.Type)
+		}
+		if len(cfg.Tag) == 0 {
+			cfg.Tag = "pmon." + proc
+		}
+	default:
+		return nil, fmt.Errorf("Unknown log forwarder type '%s'", cfg.Type)
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 10000
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5
+	}
+	f := &logForwarder{
+		cfg:     cfg,
+		proc:    proc,
+		records: make(chan *logRecord, cfg.BufferSize),
+		quit:    make(chan bool),
+	}
+	f.host, _ = os.Hostname()
+	if cfg.Type == "syslog" {
+		if _, err := parseFacility(cfg.Facility); nil != err {
+			return nil, err
+		}
+		f.syslog = newSyslogWriter(cfg.Network, cfg.Addr, f.timeout())
+	}
+	go f.run()
+	return f, nil
+}
+
+func (f *logForwarder) timeout() time.Duration {
+	return time.Duration(f.cfg.Timeout) * time.Second
+}
+
+// forward queues the line, it never blocks.
+func (f *logForwarder) forward(stream string, pid int, line []byte) {
+	rec := &logRecord{time: time.Now(), stream: stream, pid: pid, msg: append([]byte(nil), bytes.TrimRight(line, "\r\n")...)}
+	select {
+	case f.records <- rec:
+	default:
+		atomic.AddUint64(&f.dropped, 1)
+	}
+}
+
+func (f *logForwarder) close() {
+	close(f.quit)
+}
+
+func (f *logForwarder) String() string {
+	return fmt.Sprintf("%s %s %s", f.cfg.Type, f.cfg.Network, f.cfg.Addr)
+}
+
+func (f *logForwarder) run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	backoff := time.Second
+	reported := uint64(0)
+	for {
+		select {
+		case <-f.quit:
+			f.disconnect()
+			return
+		case <-ticker.C:
+			if dropped := atomic.LoadUint64(&f.dropped); dropped > reported {
+				glog.Warningf("Log forwarder %v of process:%s dropped %d lines in total", f, f.proc, dropped)
+				reported = dropped
+			}
+		case rec := <-f.records:
+			if err := f.write(rec); nil != err {
+				atomic.AddUint64(&f.dropped, 1)
+				glog.Errorf("Failed to forward log of process:%s to %v for reason:%v, retry after %v", f.proc, f, err, backoff)
+				f.disconnect()
+				//lines are buffered or dropped while waiting
+				select {
+				case <-time.After(backoff):
+				case <-f.quit:
+					return
+				}
+				if backoff *= 2; backoff > 30*time.Second {
+					backoff = 30 * time.Second
+				}
+				continue
+			}
+			atomic.AddUint64(&f.sent, 1)
+			backoff = time.Second
+		}
+	}
+}
+
+func (f *logForwarder) disconnect() {
+	if nil != f.syslog {
+		f.syslog.Close()
+	}
+	if nil != f.conn {
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+func (f *logForwarder) write(rec *logRecord) error {
+	if f.cfg.Type == "syslog" {
+		return f.syslog.write(f.syslogMessage(rec))
+	}
+	if nil == f.conn {
+		conn, err := net.DialTimeout(f.cfg.Network, f.cfg.Addr, f.timeout())
+		if nil != err {
+			return err
+		}
+		f.conn = conn
+	}
+	var data []byte
+	if f.cfg.Type == "fluent" {
+		data = f.fluentMessage(rec)
+	} else {
+		data = f.jsonMessage(rec)
+	}
+	f.conn.SetWriteDeadline(time.Now().Add(f.timeout()))
+	_, err := f.conn.Write(data)
+	return err
+}
+
+func (f *logForwarder) syslogMessage(rec *logRecord) []byte {
+	facility, _ := parseFacility(f.cfg.Facility)
+	severity := sevInfo
+	if rec.stream == "stderr" {
+		severity = sevErr
+	}
+	if strings.ToLower(f.cfg.Format) == "rfc3164" {
+		return formatRFC3164(facility, severity, rec.time, f.host, f.cfg.Tag, rec.pid, string(rec.msg))
+	}
+	return formatRFC5424(facility, severity, rec.time, f.host, f.cfg.Tag, rec.pid, rec.stream, string(rec.msg))
+}
+
+// jsonMessage encodes the record as one line of json.
+func (f *logForwarder) jsonMessage(rec *logRecord) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"time":   rec.time.Format(time.RFC3339Nano),
+		"host":   f.host,
+		"proc":   f.proc,
+		"pid":    rec.pid,
+		"stream": rec.stream,
+		"msg":    string(rec.msg),
+	})
+	return append(data, '\n')
+}
+
+// fluentMessage encodes the record in message mode of the fluent forward protocol: [tag, time, record].
+func (f *logForwarder) fluentMessage(rec *logRecord) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(0x93)
+	msgpackString(&buf, f.cfg.Tag)
+	//EventTime extension: seconds and nanoseconds in big endian
+	buf.Write([]byte{0xd7, 0x00})
+	binary.Write(&buf, binary.BigEndian, uint32(rec.time.Unix()))
+	binary.Write(&buf, binary.BigEndian, uint32(rec.time.Nanosecond()))
+	buf.WriteByte(0x80 | 5)
+	msgpackString(&buf, "host")
+	msgpackString(&buf, f.host)
+	msgpackString(&buf, "proc")
+	msgpackString(&buf, f.proc)
+	msgpackString(&buf, "pid")
+	buf.WriteByte(0xd3)
+	binary.Write(&buf, binary.BigEndian, int64(rec.pid))
+	msgpackString(&buf, "stream")
+	msgpackString(&buf, rec.stream)
+	msgpackString(&buf, "msg")
+	msgpackString(&buf, string(rec.msg))
+	return buf.Bytes()
+}
+
+func msgpackString(buf *bytes.Buffer, s string) {
+	switch n := len(s); {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n < 1<<8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(n))
+	case n < 1<<16:
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.WriteString(s)
+}
+
+// newLogForwarders creates forwarders of the process, invalid ones are logged and skipped.
+func newLogForwarders(cfgs []forwardConfig, processName string) []*logForwarder {
+	var forwarders []*logForwarder
+	for _, cfg := range cfgs {
+		f, err := newLogForwarder(cfg, filepath.Base(processName))
+		if nil != err {
+			glog.Errorf("Invalid log forwarder of process:%s for reason:%v", processName, err)
+			continue
+		}
+		forwarders = append(forwarders, f)
+	}
+	return forwarders
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var goroutineHeader = regexp.MustCompile(`^goroutine \d+ \[[^\]]*\]:$`)
+var volatileValues = regexp.MustCompile(`0x[0-9a-fA-F]+|\d+`)
+
+// parseGoPanic extracts the panic message and the top frames of the panicking goroutine from a go crash,
+// frames are formatted as "function file:line", runtime frames on top are skipped.
+func parseGoPanic(crash string, maxFrames int) (string, []string) {
+	lines := strings.Split(crash, "\n")
+	message := ""
+	i := 0
+	for ; i < len(lines); i++ {
+		if strings.HasPrefix(lines[i], "panic: ") || strings.HasPrefix(lines[i], "fatal error: ") {
+			message = strings.TrimSpace(lines[i])
+			break
+		}
+	}
+	if len(message) == 0 {
+		return "", nil
+	}
+	//the panicking goroutine is the first dumped one
+	for ; i < len(lines) && !goroutineHeader.MatchString(strings.TrimSpace(lines[i])); i++ {
+	}
+	var frames []string
+	for i++; i+1 < len(lines) && len(frames) < maxFrames; i += 2 {
+		fn := strings.TrimSpace(lines[i])
+		if len(fn) == 0 || goroutineHeader.MatchString(fn) {
+			break
+		}
+		if strings.HasPrefix(fn, "created by ") {
+			break
+		}
+		//strip the arguments
+		if idx := strings.LastIndex(fn, "("); idx > 0 && strings.HasSuffix(fn, ")") {
+			fn = fn[:idx]
+		}
+		if len(frames) == 0 && (strings.HasPrefix(fn, "runtime.") || fn == "panic") {
+			continue
+		}
+		if !strings.HasPrefix(lines[i+1], "\t") {
+			break
+		}
+		location := strings.TrimSpace(lines[i+1])
+		if idx := strings.LastIndex(location, " +0x"); idx > 0 {
+			location = location[:idx]
+		}
+		frames = append(frames, fn+" "+location)
+	}
+	return message, frames
+}
+
+// crashSignature returns a stable signature of a crash, go panics are identified by the functions of the top frames,
+// others by the first crash line without numbers and addresses.
+func crashSignature(crash string) (string, []string) {
+	message, frames := parseGoPanic(crash, 5)
+	var key string
+	if len(frames) > 0 {
+		kind := "panic"
+		if strings.HasPrefix(message, "fatal error: ") {
+			kind = "fatal error"
+		}
+		key = kind
+		for _, frame := range frames {
+			//only the function names, line numbers change between builds
+			key += "\n" + strings.SplitN(frame, " ", 2)[0]
+		}
+	} else {
+		first := strings.TrimSpace(strings.SplitN(crash, "\n", 2)[0])
+		if len(first) == 0 {
+			return "", nil
+		}
+		key = volatileValues.ReplaceAllString(first, "N")
+	}
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])[:12], frames
+}
+
+type signatureStat struct {
+	count        int
+	lastNotified time.Time
+}
+
+var crashSignatures = make(map[string]*signatureStat)
+var crashSignaturesLock sync.Mutex
+
+// countCrashSignature counts the crash of signature, and returns the occurrences and
+// whether notifications should be sent or suppressed within window.
+func countCrashSignature(signature string, window time.Duration) (int, bool) {
+	crashSignaturesLock.Lock()
+	defer crashSignaturesLock.Unlock()
+	stat, ok := crashSignatures[signature]
+	if !ok {
+		stat = new(signatureStat)
+		crashSignatures[signature] = stat
+	}
+	stat.count++
+	now := time.Now()
+	if window > 0 && now.Sub(stat.lastNotified) < window {
+		return stat.count, false
+	}
+	stat.lastNotified = now
+	return stat.count, true
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxGrepMatches limits lines sent back by one grep.
+const maxGrepMatches = 10000
+
+var grepTimeFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseGrepTime parses since/until of grep, a duration like 2h means that long ago.
+func parseGrepTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); nil == err {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range grepTimeFormats {
+		if t, err := time.ParseInLocation(layout, s, time.Local); nil == err {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid time '%s', expect a duration like 2h or 2006-01-02T15:04:05", s)
+}
+
+// lineTime returns the time of a line written with Timestamps or in json LogFormat, zero time if unknown.
+func lineTime(line []byte) time.Time {
+	if len(line) > 0 && line[0] == '{' {
+		var record struct {
+			Time string `json:"time"`
+		}
+		if nil == json.Unmarshal(line, &record) {
+			t, _ := time.Parse(time.RFC3339Nano, record.Time)
+			return t
+		}
+		return time.Time{}
+	}
+	if idx := bytes.IndexByte(line, ' '); idx > 0 {
+		t, _ := time.Parse(time.RFC3339Nano, string(line[:idx]))
+		return t
+	}
+	return time.Time{}
+}
+
+// rotatedTime returns the start time in the name of a rotated file, zero time for the current file.
+func rotatedTime(path, file string) time.Time {
+	if len(file) <= len(path)+1 || len(file) < len(path)+1+len(rotateTimeFormat) {
+		return time.Time{}
+	}
+	t, _ := time.ParseInLocation(rotateTimeFormat, file[len(path)+1:len(path)+1+len(rotateTimeFormat)], time.Local)
+	return t
+}
+
+type grepRequest struct {
+	re      *regexp.Regexp
+	since   time.Time
+	until   time.Time
+	matches int
+}
+
+// grepFile writes matched lines of the file as <file>:<line number>:<line>, it returns false once the client is gone.
+func (req *grepRequest) grepFile(file string, c io.Writer) (bool, error) {
+	f, err := os.Open(file)
+	if nil != err {
+		return true, err
+	}
+	defer f.Close()
+	var rd io.Reader = f
+	if strings.HasSuffix(file, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if nil != err {
+			return true, err
+		}
+		defer zr.Close()
+		rd = zr
+	}
+	brd := bufio.NewReaderSize(rd, 64*1024)
+	lineno := 0
+	for {
+		line, err := brd.ReadBytes('\n')
+		if len(line) > 0 {
+			lineno++
+			line = bytes.TrimRight(line, "\r\n")
+			if req.re.Match(line) && req.inRange(line) {
+				if req.matches >= maxGrepMatches {
+					fmt.Fprintf(c, "...(stopped at %d matches)\r\n", maxGrepMatches)
+					return false, nil
+				}
+				req.matches++
+				if _, werr := fmt.Fprintf(c, "%s:%d:%s\r\n", file, lineno, line); nil != werr {
+					return false, nil
+				}
+			}
+		}
+		if nil != err {
+			if err == io.EOF {
+				err = nil
+			}
+			return true, err
+		}
+	}
+}
+
+// inRange returns false only if the line has a time out of [since, until].
+func (req *grepRequest) inRange(line []byte) bool {
+	if req.since.IsZero() && req.until.IsZero() {
+		return true
+	}
+	t := lineTime(line)
+	if t.IsZero() {
+		return true
+	}
+	return !t.Before(req.since) && (req.until.IsZero() || !t.After(req.until))
+}
+
+// grepLog searches current and rotated log files of processes, files out of [since, until] are skipped.
+func grepLog(args []string, c io.ReadWriteCloser) bool {
+	re, err := regexp.Compile(args[1])
+	if nil != err {
+		fmt.Fprintf(c, "Invalid regex '%s':%v\r\n", args[1], err)
+		return false
+	}
+	req := &grepRequest{re: re}
+	if len(args) > 2 {
+		if req.since, err = parseGrepTime(args[2]); nil != err {
+			fmt.Fprintf(c, "%v\r\n", err)
+			return false
+		}
+	}
+	if len(args) > 3 {
+		if req.until, err = parseGrepTime(args[3]); nil != err {
+			fmt.Fprintf(c, "%v\r\n", err)
+			return false
+		}
+	}
+	procs := matchProcs(args[0])
+	if len(procs) == 0 {
+		fmt.Fprintf(c, "No process found by name '%s'\r\n", args[0])
+		return false
+	}
+	searched := make(map[string]bool)
+	for _, proc := range procs {
+		for _, path := range proc.logFiles() {
+			if searched[path] {
+				continue
+			}
+			searched[path] = true
+			for _, file := range append(rotatedFiles(path), path) {
+				st, err := os.Stat(file)
+				if nil != err {
+					continue
+				}
+				//the file is written from its start time until it is last modified
+				if st.ModTime().Before(req.since) {
+					continue
+				}
+				if start := rotatedTime(path, file); !req.until.IsZero() && start.After(req.until) {
+					continue
+				}
+				more, err := req.grepFile(file, c)
+				if nil != err {
+					fmt.Fprintf(c, "Failed to grep %s for reason:%v\r\n", file, err)
+				}
+				if !more {
+					return true
+				}
+			}
+		}
+	}
+	return true
+}
@@ -6,45 +6,171 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/golang/glog"
 )
 
+type diagConfig struct {
+	Signal   string //signal sent before the kill, e.g. SIGQUIT makes go programs dump all goroutines
+	Wait     int    //seconds to capture the output after Signal, default 2
+	PprofURL string //URL fetched before the kill, e.g. http://127.0.0.1:6060/debug/pprof/goroutine?debug=2
+}
+
 type checkConfig struct {
-	Addr    string
-	Period  int
-	Timeout int
+	Type         string //tcp(default), http, https, command, unix, file, grpc
+	Addr         string //host:port, or socket path for unix check
+	Period       int
+	Timeout      int
+	Path         string            //http request path
+	Method       string            //http request method, default GET
+	Headers      map[string]string //http request headers
+	ExpectStatus int               //expected http status, default any 2xx
+	ExpectBody   string            //regex the http response body must match
+	Service      string            //grpc health service name, empty for the whole server
+	TLS          bool              //use TLS for grpc check, https always does
+	Insecure     bool              //skip TLS certificate verification
+	CAFile       string            //CA certificates to verify the server
+	CertFile     string            //client certificate
+	KeyFile      string            //client certificate key
+	ServerName   string            //server name used to verify the certificate
+	Command      []string          //probe command, a non zero exit means failure
+	Send         string            //data written after connected, supports escapes like \r\n and \x00
+	Expect       string            //regex the reply must match
+	ReadTimeout  int               //seconds to wait for the expected reply, default Timeout
+	File         string            //heartbeat file for file check
+	MaxAge       int               //max seconds since the heartbeat file was modified
+
+	FailureThreshold int        //consecutive failures before taking Action, default 1
+	SuccessThreshold int        //consecutive successes before an unhealthy process is healthy again, default 1
+	Action           string     //restart(default), signal, command, alert
+	Signal           string     //signal sent by the signal action, e.g. SIGUSR1
+	ActionCommand    []string   //command run by the command action
+	OnUnhealthy      diagConfig //diagnostics collected before the restart action kills the process
 }
 
 type crashConfig struct {
-	Prefix  string
-	Command []string
+	Prefix         string
+	Patterns       []string //regexes matching the first line of a crash, default recognise go, java and python crashes
+	MaxLines       int      //max captured crash lines, default 1000
+	MaxBytes       int      //max captured crash bytes, default 1MB
+	TailLines      int      //last lines of output kept for crash reports, default 100
+	Command        []string //run on crash with PMON_PROC, PMON_PID, PMON_EXIT_CODE, PMON_CRASH_FILE, PMON_HOST... in the environment
+	CommandTimeout int      //seconds, default 60
+	DedupWindow    int      //seconds to suppress notifications of crashes with the same signature, default 600, -1 disables
+}
+
+type coreConfig struct {
+	Enable   bool   //raise RLIMIT_CORE for the process and collect its core files
+	Dir      string //working directory of the process, where cores of a relative kernel core_pattern are written, default the working directory of pmond
+	Compress bool   //gzip collected core files
+	MaxCount int    //max collected core files kept per process, default 3
+	MaxSize  int    //max MB of collected core files kept per process, 0 means no limit
+}
+
+type logConfig struct {
+	MaxSize      int    //MB before the log file is rotated, default 1024, -1 disables
+	MaxBackups   int    //rotated files kept, default 2, -1 means no limit
+	Rotate       string //hourly or daily rotation besides MaxSize
+	Compress     bool   //gzip rotated files
+	MaxTotalSize int    //max MB of the log file and its rotated files, 0 means no limit
+}
+
+type forwardConfig struct {
+	Type       string //syslog, json(newline delimited), fluent(fluent forward protocol)
+	Network    string //unix, unixgram, udp, tcp, default unix for syslog, tcp for others
+	Addr       string //host:port or socket path, default /dev/log for syslog
+	Format     string //syslog format: rfc5424(default) or rfc3164
+	Facility   string //syslog facility, default daemon
+	Tag        string //syslog app name, default the process name; fluent tag, default pmon.<process name>
+	BufferSize int    //max lines buffered while the collector is slow or down, default 10000
+	Timeout    int    //seconds to connect and write, default 5
 }
 
 type procConfig struct {
-	Proc    string
-	LogFile string
-	Env     []string
-	Crash   crashConfig
-	Check   checkConfig
+	Proc            string
+	LogFile         string
+	StdoutFile      string //stdout of the process, default LogFile
+	StderrFile      string //stderr of the process, default LogFile
+	Timestamps      bool   //prefix each line with RFC 3339 time and the stream name
+	LogFormat       string //text(default) or json, json writes each line as an object with time, proc, instance, pid, stream and msg
+	Log             logConfig
+	Forward         []forwardConfig //forward output lines to log collectors
+	Env             []string
+	Crash           crashConfig
+	Check           checkConfig
+	CoreDumps       coreConfig
+	MaxUptime       int                 //restart the process after running this many seconds, 0 means never
+	RestartSchedule string              //cron style restart schedule, e.g. "30 3 * * *"
+	RestartJitter   int                 //max random delay in seconds added to scheduled restarts
+	StopTimeout     int                 //seconds to wait after SIGTERM before killing the process
+	Notify          map[string][]string //notifier name to event types sent to it, "*" for all, default all events to all notifiers
+}
+
+type webhookConfig struct {
+	URL      string
+	Headers  map[string]string
+	Secret   string //sign the body with HMAC-SHA256 in header X-Pmon-Signature
+	Retries  int    //default 3, -1 disables retries
+	Backoff  int    //seconds before the first retry, doubled after each retry, default 1
+	Timeout  int    //seconds, default 5
+	QueueDir string //events failed to send are queued here and resent later, default <LogDir>/webhook-queue
+
+	QueueMaxCount int //max queued events, the oldest are dropped, default 1000
+	QueueMaxSize  int //max MB of queued events, default 10
+}
+
+type notifierConfig struct {
+	Type          string   //syslog, smtp, command, webhook
+	Network       string   //syslog network: unix(default), udp, tcp
+	Addr          string   //syslog address, default /dev/log; smtp server host:port
+	Facility      string   //syslog facility, default daemon
+	Tag           string   //syslog app name, default pmond
+	From          string   //smtp sender
+	To            []string //smtp recipients
+	Username      string   //smtp PLAIN auth
+	Password      string
+	Command       []string //run with PMON_EVENT, PMON_PROC, PMON_MESSAGE, PMON_EVENT_FILE... in the environment
+	webhookConfig          //webhook URL, Headers, Secret..., Timeout applies to all types
+	RateLimit     int      //max events sent per minute, the rest are batched into a digest, default 10, -1 disables
+	Digest        int      //seconds between digests of rate limited events, default 300
+}
+
+type auditConfig struct {
+	File      string //json lines audit log of admin commands, default <LogDir>/audit.log
+	logConfig        //rotation of the audit log, default MaxSize 100 and MaxBackups 10
 }
 
 type procMonConfig struct {
-	Listen        string
-	Auth          string
-	BackupDir     string
-	MaxBackupFile int
-	UploadDir     string
-	LogDir        string
-	Monitor       []procConfig
+	Listen          string
+	Auth            string
+	BackupDir       string
+	MaxBackupFile   int
+	UploadDir       string
+	LogDir          string
+	MaxCrashReports int           //crash reports kept in LogDir, default 100
+	MaxCrashAge     int           //days to keep crash reports, default 30
+	Webhook         webhookConfig //same as a webhook notifier named "webhook"
+	Notifiers       map[string]notifierConfig
+	Audit           auditConfig
+	Monitor         []procConfig
 }
 
 var Cfg procMonConfig
+var cfgLock sync.RWMutex
 var confPath string
 
+// getConfig returns a snapshot of the current config, Cfg is replaced as a whole on reload.
+func getConfig() procMonConfig {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
+	return Cfg
+}
+
 type LogWriter struct {
 }
 
@@ -69,30 +195,45 @@ func watchConfFile() {
 		}
 		if st.ModTime().Unix() > confFileTime {
 			data, _ := ioutil.ReadAll(file)
-			err = json.Unmarshal(data, &Cfg)
+			var cfg procMonConfig
+			err = json.Unmarshal(data, &cfg)
 			if nil != err {
 				glog.Errorf("Failed to unmarshal json to config for reason:%v", err)
 				return
 			}
-			if len(Cfg.UploadDir) == 0 {
-				Cfg.UploadDir = "./upload"
+			if len(cfg.UploadDir) == 0 {
+				cfg.UploadDir = "./upload"
+			}
+			if len(cfg.BackupDir) == 0 {
+				cfg.BackupDir = "./backup"
+			}
+			if cfg.MaxBackupFile == 0 {
+				cfg.MaxBackupFile = 10
 			}
-			if len(Cfg.BackupDir) == 0 {
-				Cfg.BackupDir = "./backup"
+			if cfg.MaxCrashReports <= 0 {
+				cfg.MaxCrashReports = 100
+			}
+			if cfg.MaxCrashAge <= 0 {
+				cfg.MaxCrashAge = 30
 			}
 
-			if len(Cfg.LogDir) == 0 {
+			if len(cfg.LogDir) == 0 {
 				if logDirFlag := flag.Lookup("log_dir"); nil != logDirFlag {
-					Cfg.LogDir = logDirFlag.Value.String()
+					cfg.LogDir = logDirFlag.Value.String()
 				} else {
-					Cfg.LogDir = "./logs"
+					cfg.LogDir = "./logs"
 				}
 			}
-			os.MkdirAll(Cfg.UploadDir, 0770)
-			os.MkdirAll(Cfg.BackupDir, 0770)
-			os.MkdirAll(Cfg.LogDir, 0770)
+			os.MkdirAll(cfg.UploadDir, 0770)
+			os.MkdirAll(cfg.BackupDir, 0770)
+			os.MkdirAll(cfg.LogDir, 0770)
+			cfgLock.Lock()
+			Cfg = cfg
+			cfgLock.Unlock()
 			confFileTime = st.ModTime().Unix()
-			buildMonitorProcs()
+			setupNotifiers(&cfg)
+			setupAudit(&cfg)
+			buildMonitorProcs(&cfg)
 		}
 	}
 
@@ -105,12 +246,36 @@ func watchConfFile() {
 	}()
 }
 
+// logFile is the -log_file flag, logs of pmond are written to it by stderr.
+var logFile string
+
+// reopenLogFile points stderr to logFile opened again by path, e.g. after it is moved by logrotate.
+func reopenLogFile() error {
+	if len(logFile) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+	return redirectStderr(f)
+}
+
 func main() {
 	conf := flag.String("conf", "./conf/pmon.json", "config file")
 	var gracefulChild bool
 	flag.BoolVar(&gracefulChild, "graceful", false, "listen on fd open 3 (internal use only)")
+	flag.StringVar(&logFile, "log_file", "", "write logs of pmond to this file instead of glog files in log_dir, the file is reopened on SIGHUP")
 	flag.Parse()
 	defer glog.Flush()
+	if len(logFile) > 0 {
+		flag.Set("logtostderr", "true")
+		if err := reopenLogFile(); nil != err {
+			glog.Errorf("Failed to open log file:%s for reason:%v", logFile, err)
+			return
+		}
+	}
 
 	var err error
 	confPath, err = filepath.Abs(*conf)
@@ -129,6 +294,16 @@ func main() {
 	// }()
 
 	watchConfFile()
+	dumpPids()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			glog.Infof("Reopen log files on SIGHUP.")
+			reopenAllLogs()
+		}
+	}()
 
 	//start admin server
 	var l net.Listener
@@ -137,7 +312,7 @@ func main() {
 		f := os.NewFile(3, "")
 		l, err = net.FileListener(f)
 	} else {
-		l, err = net.Listen("tcp", Cfg.Listen)
+		l, err = net.Listen("tcp", getConfig().Listen)
 	}
 	if nil != err {
 		glog.Errorf("Bind socket failed:%v", err)
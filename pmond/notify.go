@@ -0,0 +1,630 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// event is a crash or lifecycle event of a monitored process sent to notifiers.
+type event struct {
+	Type    string //crash, restart, health-fail, deploy, rollback, digest
+	Proc    string
+	Host    string
+	Pid     int `json:",omitempty"`
+	Time    time.Time
+	Message string       `json:",omitempty"`
+	Report  *crashReport `json:",omitempty"`
+	Events  []*event     `json:",omitempty"` //rate limited events batched in a digest
+
+	routes map[string][]string //Notify of the process, nil sends the event to all notifiers
+}
+
+// routed returns true if the event should be sent to the named notifier.
+func (ev *event) routed(name string) bool {
+	if nil == ev.routes {
+		return true
+	}
+	for _, t := range ev.routes[name] {
+		if t == "*" || strings.EqualFold(t, ev.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// newDigest batches rate limited events into one digest event.
+func newDigest(events []*event, dropped int) *event {
+	var keys, procs []string
+	counts := make(map[string]int)
+	seen := make(map[string]bool)
+	for _, ev := range events {
+		name := filepath.Base(ev.Proc)
+		if !seen[name] {
+			seen[name] = true
+			procs = append(procs, name)
+		}
+		key := ev.Type + " of " + name
+		if counts[key] == 0 {
+			keys = append(keys, key)
+		}
+		counts[key]++
+	}
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s x%d", key, counts[key]))
+	}
+	msg := fmt.Sprintf("%d events rate limited: %s", len(events)+dropped, strings.Join(parts, ", "))
+	if dropped > 0 {
+		msg += fmt.Sprintf(", %d more dropped", dropped)
+	}
+	digest := &event{Type: "digest", Proc: strings.Join(procs, ","), Time: time.Now(), Message: msg, Events: events}
+	digest.Host, _ = os.Hostname()
+	return digest
+}
+
+// notifier delivers events to one kind of destination.
+type notifier interface {
+	send(ev *event) error
+	close()
+}
+
+type notifierFactory func(cfg *notifierConfig, quit chan bool) (notifier, error)
+
+var notifierFactories = make(map[string]notifierFactory)
+
+// maxDigestEvents limits events kept for the next digest, later ones are only counted.
+const maxDigestEvents = 1000
+
+// notifySink runs a notifier in background, events over RateLimit per minute are batched into a digest sent every Digest seconds.
+type notifySink struct {
+	name   string
+	cfg    notifierConfig
+	n      notifier
+	events chan *event
+	quit   chan bool
+}
+
+var notifySinks = make(map[string]*notifySink)
+var notifierLock sync.Mutex
+
+func (s *notifySink) deliver(ev *event) {
+	if err := s.n.send(ev); nil != err {
+		glog.Errorf("Failed to send %s event of %s to notifier:%s for reason:%v", ev.Type, ev.Proc, s.name, err)
+	}
+}
+
+// flusher is implemented by notifiers resending failed events periodically.
+type flusher interface {
+	flush()
+}
+
+func (s *notifySink) run() {
+	defer s.n.close()
+	digestTicker := time.NewTicker(time.Duration(s.cfg.Digest) * time.Second)
+	defer digestTicker.Stop()
+	flushTicker := time.NewTicker(30 * time.Second)
+	defer flushTicker.Stop()
+	var pending []*event
+	dropped := 0
+	windowStart := time.Now()
+	sent := 0
+	for {
+		select {
+		case <-s.quit:
+			if len(pending) > 0 {
+				s.deliver(newDigest(pending, dropped))
+			}
+			return
+		case <-flushTicker.C:
+			if f, ok := s.n.(flusher); ok {
+				f.flush()
+			}
+		case <-digestTicker.C:
+			if len(pending) > 0 {
+				s.deliver(newDigest(pending, dropped))
+				pending = nil
+				dropped = 0
+			}
+		case ev := <-s.events:
+			if now := time.Now(); now.Sub(windowStart) >= time.Minute {
+				windowStart = now
+				sent = 0
+			}
+			if s.cfg.RateLimit < 0 || sent < s.cfg.RateLimit {
+				sent++
+				s.deliver(ev)
+			} else if len(pending) < maxDigestEvents {
+				pending = append(pending, ev)
+			} else {
+				dropped++
+			}
+		}
+	}
+}
+
+func notifierDefaults(name string, cfg notifierConfig, logDir string) notifierConfig {
+	cfg.Type = strings.ToLower(cfg.Type)
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5
+		if cfg.Type == "command" {
+			cfg.Timeout = 60
+		}
+	}
+	if cfg.RateLimit == 0 {
+		cfg.RateLimit = 10
+	}
+	if cfg.Digest <= 0 {
+		cfg.Digest = 300
+	}
+	if cfg.Type == "webhook" {
+		if cfg.Retries == 0 {
+			cfg.Retries = 3
+		}
+		if cfg.Backoff <= 0 {
+			cfg.Backoff = 1
+		}
+		if len(cfg.QueueDir) == 0 {
+			cfg.QueueDir = logDir + "/" + name + "-queue"
+		}
+		if cfg.QueueMaxCount <= 0 {
+			cfg.QueueMaxCount = 1000
+		}
+		if cfg.QueueMaxSize <= 0 {
+			cfg.QueueMaxSize = 10
+		}
+	}
+	return cfg
+}
+
+// setupNotifiers (re)creates notifiers on config reload, unchanged notifiers keep running.
+func setupNotifiers(cfg *procMonConfig) {
+	cfgs := make(map[string]notifierConfig)
+	if len(cfg.Webhook.URL) > 0 {
+		cfgs["webhook"] = notifierConfig{Type: "webhook", webhookConfig: cfg.Webhook}
+	}
+	for name, ncfg := range cfg.Notifiers {
+		cfgs[name] = ncfg
+	}
+	notifierLock.Lock()
+	defer notifierLock.Unlock()
+	sinks := make(map[string]*notifySink)
+	for name, ncfg := range cfgs {
+		ncfg = notifierDefaults(name, ncfg, cfg.LogDir)
+		if s, ok := notifySinks[name]; ok && reflect.DeepEqual(s.cfg, ncfg) {
+			sinks[name] = s
+			continue
+		}
+		factory, ok := notifierFactories[ncfg.Type]
+		if !ok {
+			glog.Errorf("Unknown type '%s' of notifier:%s", ncfg.Type, name)
+			continue
+		}
+		quit := make(chan bool)
+		n, err := factory(&ncfg, quit)
+		if nil != err {
+			glog.Errorf("Failed to create notifier:%s for reason:%v", name, err)
+			continue
+		}
+		s := &notifySink{name: name, cfg: ncfg, n: n, events: make(chan *event, 1024), quit: quit}
+		sinks[name] = s
+		go s.run()
+	}
+	for name, s := range notifySinks {
+		if sinks[name] != s {
+			close(s.quit)
+		}
+	}
+	notifySinks = sinks
+}
+
+// notify sends the event to configured notifiers in background, it never blocks the caller.
+func notify(ev *event) {
+	ev.Host, _ = os.Hostname()
+	ev.Time = time.Now()
+	notifierLock.Lock()
+	defer notifierLock.Unlock()
+	for name, s := range notifySinks {
+		if !ev.routed(name) {
+			continue
+		}
+		select {
+		case s.events <- ev:
+		default:
+			glog.Errorf("Notifier:%s event queue full, drop %s event of %s", name, ev.Type, ev.Proc)
+		}
+	}
+}
+
+// procRoutes merges Notify of the processes, nil if any of them sends all events to all notifiers.
+func procRoutes(procs []*monitorProc) map[string][]string {
+	if len(procs) == 0 {
+		return nil
+	}
+	routes := make(map[string][]string)
+	for _, proc := range procs {
+		proc.lk.Lock()
+		notify := proc.cfg.Notify
+		proc.lk.Unlock()
+		if nil == notify {
+			return nil
+		}
+		for name, types := range notify {
+			routes[name] = append(routes[name], types...)
+		}
+	}
+	return routes
+}
+
+// webhookNotifier POSTs events as json, events failed after all retries are queued on disk and resent later.
+// Events rejected by the endpoint, e.g. with a 4xx status, are dropped since resending never helps.
+type webhookNotifier struct {
+	cfg     notifierConfig
+	client  *http.Client
+	backoff time.Duration
+	quit    chan bool
+}
+
+// webhookStatusError is a failure status returned by the webhook endpoint.
+type webhookStatusError struct {
+	url    string
+	status int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook %s got status %d", e.url, e.status)
+}
+
+// retryable returns true for network errors, 5xx and 429 status, other failures are permanent.
+func retryable(err error) bool {
+	if serr, ok := err.(*webhookStatusError); ok {
+		return serr.status >= 500 || serr.status == http.StatusTooManyRequests
+	}
+	return true
+}
+
+func newWebhookNotifier(cfg *notifierConfig, quit chan bool) (notifier, error) {
+	if len(cfg.URL) == 0 {
+		return nil, fmt.Errorf("Empty webhook URL")
+	}
+	w := &webhookNotifier{
+		cfg:     *cfg,
+		client:  &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+		backoff: time.Duration(cfg.Backoff) * time.Second,
+		quit:    quit,
+	}
+	os.MkdirAll(cfg.QueueDir, 0770)
+	return w, nil
+}
+
+func (w *webhookNotifier) post(data []byte) error {
+	req, err := http.NewRequest("POST", w.cfg.URL, bytes.NewReader(data))
+	if nil != err {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if len(w.cfg.Secret) > 0 {
+		mac := hmac.New(sha256.New, []byte(w.cfg.Secret))
+		mac.Write(data)
+		req.Header.Set("X-Pmon-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	res, err := w.client.Do(req)
+	if nil != err {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return &webhookStatusError{w.cfg.URL, res.StatusCode}
+	}
+	return nil
+}
+
+// deliver posts data with Retries retries, the backoff is doubled after each failure.
+func (w *webhookNotifier) deliver(data []byte) error {
+	backoff := w.backoff
+	var err error
+	for i := 0; i <= w.cfg.Retries || i == 0; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-w.quit:
+				return err
+			}
+			backoff *= 2
+		}
+		if err = w.post(data); nil == err || !retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// queue writes data to QueueDir, then drops the oldest events over QueueMaxCount or QueueMaxSize.
+func (w *webhookNotifier) queue(data []byte) {
+	path := fmt.Sprintf("%s/%d.json", w.cfg.QueueDir, time.Now().UnixNano())
+	if err := ioutil.WriteFile(path, data, 0660); nil != err {
+		glog.Errorf("Failed to queue webhook event for reason:%v", err)
+		return
+	}
+	files := w.queuedFiles()
+	var total int64
+	for i := len(files) - 1; i >= 0; i-- {
+		st, err := os.Stat(files[i])
+		if nil != err {
+			continue
+		}
+		total += st.Size()
+		if len(files)-i > w.cfg.QueueMaxCount || total > int64(w.cfg.QueueMaxSize)*1024*1024 {
+			glog.Errorf("Webhook queue %s is full, drop queued event %s", w.cfg.QueueDir, files[i])
+			os.Remove(files[i])
+		}
+	}
+}
+
+// queuedFiles returns queued events, oldest first.
+func (w *webhookNotifier) queuedFiles() []string {
+	files, _ := filepath.Glob(w.cfg.QueueDir + "/*.json")
+	sort.Strings(files)
+	return files
+}
+
+func (w *webhookNotifier) drop(data []byte, err error) {
+	glog.Errorf("Drop webhook event rejected for reason:%v, event:%q", err, truncate(data, 4096))
+}
+
+// flushQueue resends queued events in order, it stops at the first failure worth retrying.
+func (w *webhookNotifier) flushQueue() bool {
+	for _, file := range w.queuedFiles() {
+		data, err := ioutil.ReadFile(file)
+		if nil != err {
+			continue
+		}
+		if err = w.post(data); nil != err {
+			if retryable(err) {
+				return false
+			}
+			w.drop(data, err)
+		}
+		os.Remove(file)
+	}
+	return true
+}
+
+func (w *webhookNotifier) flush() {
+	w.flushQueue()
+}
+
+func (w *webhookNotifier) send(ev *event) error {
+	data, _ := json.Marshal(ev)
+	//keep the order of events, never send new events before queued ones
+	if !w.flushQueue() {
+		w.queue(data)
+		return nil
+	}
+	if err := w.deliver(data); nil != err {
+		if !retryable(err) {
+			return fmt.Errorf("%v, dropped", err)
+		}
+		w.queue(data)
+		return fmt.Errorf("%v, queued", err)
+	}
+	return nil
+}
+
+func (w *webhookNotifier) close() {
+}
+
+// syslogNotifier writes one RFC 5424 message per event, the MSGID is the event type.
+type syslogNotifier struct {
+	facility int
+	tag      string
+	w        *syslogWriter
+}
+
+func newSyslogNotifier(cfg *notifierConfig, quit chan bool) (notifier, error) {
+	facility, err := parseFacility(cfg.Facility)
+	if nil != err {
+		return nil, err
+	}
+	s := &syslogNotifier{
+		facility: facility,
+		tag:      cfg.Tag,
+		w:        newSyslogWriter(cfg.Network, cfg.Addr, time.Duration(cfg.Timeout)*time.Second),
+	}
+	if len(s.tag) == 0 {
+		s.tag = "pmond"
+	}
+	return s, nil
+}
+
+func eventSeverity(ev *event) int {
+	switch ev.Type {
+	case "crash":
+		return sevCrit
+	case "health-fail":
+		return sevErr
+	case "restart", "digest":
+		return sevWarning
+	case "deploy", "rollback":
+		return sevNotice
+	}
+	return sevInfo
+}
+
+func (s *syslogNotifier) send(ev *event) error {
+	msg := ev.Message
+	if nil != ev.Report && len(ev.Report.Signature) > 0 {
+		msg += " signature:" + ev.Report.Signature
+	}
+	return s.w.write(formatRFC5424(s.facility, eventSeverity(ev), ev.Time, ev.Host, s.tag, ev.Pid, ev.Type, msg))
+}
+
+func (s *syslogNotifier) close() {
+	s.w.Close()
+}
+
+// smtpNotifier mails events, STARTTLS is used if the server supports it.
+type smtpNotifier struct {
+	cfg notifierConfig
+}
+
+func newSmtpNotifier(cfg *notifierConfig, quit chan bool) (notifier, error) {
+	if len(cfg.Addr) == 0 || len(cfg.To) == 0 {
+		return nil, fmt.Errorf("Addr and To are required by smtp notifier")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Addr); nil != err {
+		return nil, err
+	}
+	return &smtpNotifier{cfg: *cfg}, nil
+}
+
+func (m *smtpNotifier) message(ev *event) []byte {
+	from := m.cfg.From
+	if len(from) == 0 {
+		from = "pmond@" + ev.Host
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(m.cfg.To, ", "))
+	fmt.Fprintf(&buf, "Subject: [pmon] %s %s on %s\r\n", ev.Type, filepath.Base(ev.Proc), ev.Host)
+	fmt.Fprintf(&buf, "Date: %s\r\n", ev.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "%s\n", ev.Message)
+	if nil != ev.Report {
+		fmt.Fprintf(&buf, "\n%s", ev.Report.text())
+	}
+	for _, e := range ev.Events {
+		fmt.Fprintf(&buf, "%s %s %s: %s\n", e.Time.Format(time.RFC3339), e.Type, e.Proc, e.Message)
+	}
+	return buf.Bytes()
+}
+
+func (m *smtpNotifier) send(ev *event) error {
+	host, _, _ := net.SplitHostPort(m.cfg.Addr)
+	timeout := time.Duration(m.cfg.Timeout) * time.Second
+	conn, err := net.DialTimeout("tcp", m.cfg.Addr, timeout)
+	if nil != err {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, err := smtp.NewClient(conn, host)
+	if nil != err {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); nil != err {
+			return err
+		}
+	}
+	if len(m.cfg.Username) > 0 {
+		if err = c.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, host)); nil != err {
+			return err
+		}
+	}
+	msg := m.message(ev)
+	from := m.cfg.From
+	if len(from) == 0 {
+		from = "pmond@" + ev.Host
+	}
+	if err = c.Mail(from); nil != err {
+		return err
+	}
+	for _, to := range m.cfg.To {
+		if err = c.Rcpt(to); nil != err {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if nil != err {
+		return err
+	}
+	if _, err = w.Write(msg); nil != err {
+		return err
+	}
+	if err = w.Close(); nil != err {
+		return err
+	}
+	return c.Quit()
+}
+
+func (m *smtpNotifier) close() {
+}
+
+// commandNotifier runs a command per event, the event is passed in the environment and as a json file.
+type commandNotifier struct {
+	cfg notifierConfig
+}
+
+func newCommandNotifier(cfg *notifierConfig, quit chan bool) (notifier, error) {
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("Empty notifier command")
+	}
+	return &commandNotifier{cfg: *cfg}, nil
+}
+
+func (n *commandNotifier) send(ev *event) error {
+	eventFile, err := ioutil.TempFile("", "pmon-event-")
+	if nil != err {
+		return err
+	}
+	defer os.Remove(eventFile.Name())
+	data, _ := json.MarshalIndent(ev, "", "  ")
+	eventFile.Write(data)
+	eventFile.Close()
+
+	timeout := time.Duration(n.cfg.Timeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := probeCommand(ctx, n.cfg.Command)
+	cmd.Env = append(os.Environ(),
+		"PMON_EVENT="+ev.Type,
+		"PMON_PROC="+filepath.Base(ev.Proc),
+		fmt.Sprintf("PMON_PID=%d", ev.Pid),
+		"PMON_HOST="+ev.Host,
+		"PMON_MESSAGE="+ev.Message,
+		fmt.Sprintf("PMON_EVENT_COUNT=%d", len(ev.Events)),
+		"PMON_EVENT_FILE="+eventFile.Name())
+	output, err := combinedOutput(cmd)
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timeout after %v", timeout)
+	}
+	if nil != err {
+		return fmt.Errorf("command %v failed:%v, output:%q", n.cfg.Command, err, truncate(output, 4096))
+	}
+	return nil
+}
+
+func (n *commandNotifier) close() {
+}
+
+func init() {
+	notifierFactories["webhook"] = newWebhookNotifier
+	notifierFactories["syslog"] = newSyslogNotifier
+	notifierFactories["smtp"] = newSmtpNotifier
+	notifierFactories["command"] = newCommandNotifier
+}
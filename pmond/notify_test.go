@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer records posted events, status decides the reply of each request.
+type webhookServer struct {
+	*httptest.Server
+	lk       sync.Mutex
+	bodies   [][]byte
+	times    []time.Time
+	sigs     []string
+	status   func(ev *event) int
+	attempts int
+}
+
+func newWebhookServer(t *testing.T) *webhookServer {
+	ws := &webhookServer{status: func(ev *event) int { return http.StatusOK }}
+	ws.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var ev event
+		json.Unmarshal(body, &ev)
+		ws.lk.Lock()
+		ws.attempts++
+		ws.times = append(ws.times, time.Now())
+		status := ws.status(&ev)
+		if status == http.StatusOK {
+			ws.bodies = append(ws.bodies, body)
+			ws.sigs = append(ws.sigs, r.Header.Get("X-Pmon-Signature"))
+		}
+		ws.lk.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(ws.Close)
+	return ws
+}
+
+func (ws *webhookServer) setStatus(status func(ev *event) int) {
+	ws.lk.Lock()
+	defer ws.lk.Unlock()
+	ws.status = status
+}
+
+func (ws *webhookServer) messages() []string {
+	ws.lk.Lock()
+	defer ws.lk.Unlock()
+	var msgs []string
+	for _, body := range ws.bodies {
+		var ev event
+		json.Unmarshal(body, &ev)
+		msgs = append(msgs, ev.Message)
+	}
+	return msgs
+}
+
+func newTestWebhook(t *testing.T, url string, cfg notifierConfig) *webhookNotifier {
+	cfg.Type = "webhook"
+	cfg.URL = url
+	cfg.QueueDir = t.TempDir()
+	cfg = notifierDefaults("webhook", cfg, t.TempDir())
+	quit := make(chan bool)
+	t.Cleanup(func() { close(quit) })
+	n, err := newWebhookNotifier(&cfg, quit)
+	if nil != err {
+		t.Fatal(err)
+	}
+	w := n.(*webhookNotifier)
+	w.backoff = 20 * time.Millisecond
+	return w
+}
+
+func TestWebhookSignature(t *testing.T) {
+	ws := newWebhookServer(t)
+	w := newTestWebhook(t, ws.URL, notifierConfig{webhookConfig: webhookConfig{Secret: "s3cret"}})
+	if err := w.send(&event{Type: "crash", Message: "m1"}); nil != err {
+		t.Fatal(err)
+	}
+	if len(ws.bodies) != 1 {
+		t.Fatalf("expected 1 post, got %d", len(ws.bodies))
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(ws.bodies[0])
+	if expected := "sha256=" + hex.EncodeToString(mac.Sum(nil)); ws.sigs[0] != expected {
+		t.Errorf("expected signature %s, got %s", expected, ws.sigs[0])
+	}
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	ws := newWebhookServer(t)
+	ws.setStatus(func(ev *event) int {
+		if ws.attempts < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	w := newTestWebhook(t, ws.URL, notifierConfig{})
+	if err := w.send(&event{Type: "crash", Message: "m1"}); nil != err {
+		t.Fatal(err)
+	}
+	if ws.attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", ws.attempts)
+	}
+	//the backoff is doubled after each retry
+	if gap := ws.times[1].Sub(ws.times[0]); gap < w.backoff {
+		t.Errorf("first retry after %v, expected at least %v", gap, w.backoff)
+	}
+	if gap := ws.times[2].Sub(ws.times[1]); gap < 2*w.backoff {
+		t.Errorf("second retry after %v, expected at least %v", gap, 2*w.backoff)
+	}
+}
+
+func TestWebhookNoRetries(t *testing.T) {
+	ws := newWebhookServer(t)
+	ws.setStatus(func(ev *event) int { return http.StatusServiceUnavailable })
+	w := newTestWebhook(t, ws.URL, notifierConfig{webhookConfig: webhookConfig{Retries: -1}})
+	if err := w.send(&event{Type: "crash", Message: "m1"}); nil == err {
+		t.Fatal("expected error while the endpoint is down")
+	}
+	if ws.attempts != 1 {
+		t.Errorf("expected 1 attempt with Retries -1, got %d", ws.attempts)
+	}
+}
+
+func TestWebhookQueueAndResend(t *testing.T) {
+	ws := newWebhookServer(t)
+	ws.setStatus(func(ev *event) int { return http.StatusBadGateway })
+	w := newTestWebhook(t, ws.URL, notifierConfig{webhookConfig: webhookConfig{Retries: 1}})
+	for _, msg := range []string{"m1", "m2", "m3"} {
+		w.send(&event{Type: "crash", Message: msg})
+	}
+	if queued := w.queuedFiles(); len(queued) != 3 {
+		t.Fatalf("expected 3 queued events while the endpoint is down, got %d", len(queued))
+	}
+
+	ws.setStatus(func(ev *event) int { return http.StatusOK })
+	w.flush()
+	if err := w.send(&event{Type: "crash", Message: "m4"}); nil != err {
+		t.Fatal(err)
+	}
+	msgs := ws.messages()
+	expected := []string{"m1", "m2", "m3", "m4"}
+	if len(msgs) != len(expected) {
+		t.Fatalf("expected %v resent, got %v", expected, msgs)
+	}
+	for i := range expected {
+		if msgs[i] != expected[i] {
+			t.Fatalf("expected %v resent in order, got %v", expected, msgs)
+		}
+	}
+	if queued := w.queuedFiles(); len(queued) != 0 {
+		t.Errorf("expected empty queue, got %v", queued)
+	}
+}
+
+func TestWebhookDropRejected(t *testing.T) {
+	ws := newWebhookServer(t)
+	ws.setStatus(func(ev *event) int { return http.StatusServiceUnavailable })
+	w := newTestWebhook(t, ws.URL, notifierConfig{webhookConfig: webhookConfig{Retries: -1}})
+	w.send(&event{Type: "crash", Message: "bad"})
+	w.send(&event{Type: "crash", Message: "m1"})
+
+	//a rejected event never blocks the queue
+	ws.setStatus(func(ev *event) int {
+		if ev.Message == "bad" {
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	})
+	if err := w.send(&event{Type: "crash", Message: "m2"}); nil != err {
+		t.Fatal(err)
+	}
+	if msgs := ws.messages(); len(msgs) != 2 || msgs[0] != "m1" || msgs[1] != "m2" {
+		t.Errorf("expected [m1 m2] delivered, got %v", msgs)
+	}
+	if queued := w.queuedFiles(); len(queued) != 0 {
+		t.Errorf("expected empty queue, got %v", queued)
+	}
+	if err := w.send(&event{Type: "crash", Message: "bad"}); nil == err {
+		t.Errorf("expected error for a rejected event")
+	}
+	if queued := w.queuedFiles(); len(queued) != 0 {
+		t.Errorf("expected rejected event not queued, got %v", queued)
+	}
+}
+
+func TestWebhookQueueLimit(t *testing.T) {
+	ws := newWebhookServer(t)
+	ws.setStatus(func(ev *event) int { return http.StatusServiceUnavailable })
+	w := newTestWebhook(t, ws.URL, notifierConfig{webhookConfig: webhookConfig{Retries: -1, QueueMaxCount: 3}})
+	for _, msg := range []string{"m1", "m2", "m3", "m4", "m5"} {
+		w.send(&event{Type: "crash", Message: msg})
+	}
+	queued := w.queuedFiles()
+	if len(queued) != 3 {
+		t.Fatalf("expected 3 queued events, got %d", len(queued))
+	}
+	var ev event
+	data, _ := ioutil.ReadFile(queued[0])
+	json.Unmarshal(data, &ev)
+	if ev.Message != "m3" {
+		t.Errorf("expected the oldest events dropped, first queued is %s", ev.Message)
+	}
+}
+
+// smtpServer is a fake SMTP server keeping received mails.
+type smtpServer struct {
+	addr  string
+	lk    sync.Mutex
+	mails []smtpMail
+}
+
+type smtpMail struct {
+	from string
+	to   []string
+	auth string
+	data string
+}
+
+func newSmtpServer(t *testing.T) *smtpServer {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	s := &smtpServer{addr: lis.Addr().String()}
+	go func() {
+		for {
+			c, err := lis.Accept()
+			if nil != err {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) serve(c net.Conn) {
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	var mail smtpMail
+	io.WriteString(c, "220 fake ESMTP\r\n")
+	for {
+		line, err := rd.ReadString('\n')
+		if nil != err {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			io.WriteString(c, "250-fake\r\n250 AUTH PLAIN\r\n")
+		case "AUTH":
+			mail.auth = line
+			io.WriteString(c, "235 ok\r\n")
+		case "MAIL":
+			mail.from = line
+			io.WriteString(c, "250 ok\r\n")
+		case "RCPT":
+			mail.to = append(mail.to, line)
+			io.WriteString(c, "250 ok\r\n")
+		case "DATA":
+			io.WriteString(c, "354 go on\r\n")
+			var data bytes.Buffer
+			for {
+				dline, err := rd.ReadString('\n')
+				if nil != err {
+					return
+				}
+				if dline == ".\r\n" {
+					break
+				}
+				data.WriteString(dline)
+			}
+			mail.data = data.String()
+			s.lk.Lock()
+			s.mails = append(s.mails, mail)
+			s.lk.Unlock()
+			mail = smtpMail{}
+			io.WriteString(c, "250 queued\r\n")
+		case "QUIT":
+			io.WriteString(c, "221 bye\r\n")
+			return
+		default:
+			io.WriteString(c, "250 ok\r\n")
+		}
+	}
+}
+
+func (s *smtpServer) received() []smtpMail {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return append([]smtpMail(nil), s.mails...)
+}
+
+func (s *smtpServer) waitMails(t *testing.T, n int, timeout time.Duration) []smtpMail {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if mails := s.received(); len(mails) >= n {
+			return mails
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mails := s.received()
+	t.Fatalf("expected %d mails, got %d", n, len(mails))
+	return mails
+}
+
+func TestSmtpNotifier(t *testing.T) {
+	s := newSmtpServer(t)
+	cfg := notifierDefaults("mail", notifierConfig{
+		Type:     "smtp",
+		Addr:     s.addr,
+		From:     "pmon@example.com",
+		To:       []string{"a@example.com", "b@example.com"},
+		Username: "user",
+		Password: "pass",
+	}, t.TempDir())
+	n, err := newSmtpNotifier(&cfg, make(chan bool))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err = n.send(&event{Type: "crash", Proc: "/bin/myapp", Host: "h1", Time: time.Now(), Message: "myapp crashed"}); nil != err {
+		t.Fatal(err)
+	}
+	mails := s.received()
+	if len(mails) != 1 {
+		t.Fatalf("expected 1 mail, got %d", len(mails))
+	}
+	mail := mails[0]
+	if !strings.HasPrefix(mail.from, "MAIL FROM:<pmon@example.com>") {
+		t.Errorf("unexpected sender %q", mail.from)
+	}
+	if len(mail.to) != 2 || !strings.Contains(mail.to[1], "b@example.com") {
+		t.Errorf("unexpected recipients %v", mail.to)
+	}
+	if !strings.HasPrefix(mail.auth, "AUTH PLAIN ") {
+		t.Errorf("expected PLAIN auth, got %q", mail.auth)
+	}
+	if !strings.Contains(mail.data, "Subject: [pmon] crash myapp on h1\r\n") || !strings.Contains(mail.data, "myapp crashed") {
+		t.Errorf("unexpected mail:\n%s", mail.data)
+	}
+}
+
+func TestNotifySinkDigest(t *testing.T) {
+	s := newSmtpServer(t)
+	cfg := notifierDefaults("mail", notifierConfig{
+		Type:      "smtp",
+		Addr:      s.addr,
+		To:        []string{"oncall@example.com"},
+		RateLimit: 2,
+		Digest:    1,
+	}, t.TempDir())
+	quit := make(chan bool)
+	n, err := newSmtpNotifier(&cfg, quit)
+	if nil != err {
+		t.Fatal(err)
+	}
+	sink := &notifySink{name: "mail", cfg: cfg, n: n, events: make(chan *event, 16), quit: quit}
+	go sink.run()
+	defer close(quit)
+	for i := 0; i < 5; i++ {
+		sink.events <- &event{Type: "crash", Proc: "myapp", Host: "h1", Time: time.Now(), Message: fmt.Sprintf("crash %d", i)}
+	}
+	mails := s.waitMails(t, 3, 5*time.Second)
+	for i := 0; i < 2; i++ {
+		if !strings.Contains(mails[i].data, fmt.Sprintf("crash %d", i)) {
+			t.Errorf("expected mail of crash %d, got:\n%s", i, mails[i].data)
+		}
+	}
+	digest := mails[2].data
+	if !strings.Contains(digest, "Subject: [pmon] digest myapp") || !strings.Contains(digest, "3 events rate limited: crash of myapp x3") {
+		t.Errorf("expected one digest of 3 events, got:\n%s", digest)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if mails = s.received(); len(mails) != 3 {
+		t.Errorf("expected no more mails after the digest, got %d", len(mails))
+	}
+}
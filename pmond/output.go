@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// defaultCrashPatterns recognise crashes of common runtimes if no Crash.Prefix or Crash.Patterns configured.
+var defaultCrashPatterns = []string{
+	`^panic: `,
+	`^fatal error: `,
+	`^Exception in thread "`,
+	`^Traceback \(most recent call last\):`,
+	`^\[signal SIGSEGV`,
+	`^Segmentation fault`,
+	`^Fatal Python error: Segmentation fault`,
+}
+
+type ProcOutput struct {
+	fnames         map[string]string //stream to log file
+	logCfg         logConfig
+	timestamps     bool
+	jsonFormat     bool
+	instance       string
+	midLine        map[string]bool //the last write of the stream ended without newline
+	crash          crashConfig
+	crashPatterns  []*regexp.Regexp
+	crashOutput    bool
+	crashLines     int
+	crashTruncated bool
+	crashContent   bytes.Buffer
+	tail           *lineRing
+	proc           *monitorProc
+	logs           map[string]*rotateFile //log file to the opened file, streams may share one file
+	tee            io.Writer
+	forwarders     []*logForwarder
+	pid            int
+	pipes          []*os.File
+	readers        sync.WaitGroup
+	closed         bool
+	lk             sync.Mutex
+}
+
+func newProcOutput(mproc *monitorProc, cfg *procConfig) *ProcOutput {
+	pout := &ProcOutput{}
+	pout.fnames = map[string]string{"stdout": cfg.LogFile, "stderr": cfg.LogFile}
+	if len(cfg.StdoutFile) > 0 {
+		pout.fnames["stdout"] = cfg.StdoutFile
+	}
+	if len(cfg.StderrFile) > 0 {
+		pout.fnames["stderr"] = cfg.StderrFile
+	}
+	pout.logCfg = cfg.Log
+	pout.timestamps = cfg.Timestamps
+	pout.jsonFormat = strings.ToLower(cfg.LogFormat) == "json"
+	pout.instance = cfg.Proc
+	pout.midLine = make(map[string]bool)
+	pout.logs = make(map[string]*rotateFile)
+	pout.crash = cfg.Crash
+	pout.proc = mproc
+	patterns := cfg.Crash.Patterns
+	if len(cfg.Crash.Prefix) > 0 {
+		patterns = append([]string{"^" + regexp.QuoteMeta(cfg.Crash.Prefix)}, patterns...)
+	}
+	if len(patterns) == 0 {
+		patterns = defaultCrashPatterns
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if nil != err {
+			glog.Errorf("Invalid crash pattern '%s' for process:%s for reason:%v", pattern, mproc.processName, err)
+			continue
+		}
+		pout.crashPatterns = append(pout.crashPatterns, re)
+	}
+	if pout.crash.MaxLines <= 0 {
+		pout.crash.MaxLines = 1000
+	}
+	if pout.crash.MaxBytes <= 0 {
+		pout.crash.MaxBytes = 1024 * 1024
+	}
+	pout.tail = newLineRing(cfg.Crash.TailLines)
+	pout.forwarders = mproc.forwarders
+	return pout
+}
+
+// open returns the log file of the stream, it is opened on first use.
+func (pout *ProcOutput) open(stream string) *rotateFile {
+	fname := pout.fnames[stream]
+	if rfile, ok := pout.logs[fname]; ok {
+		return rfile
+	}
+	rfile, err := openRotateFile(fname, &pout.logCfg)
+	if nil != err {
+		glog.Errorf("%v", err)
+		return nil
+	}
+	pout.logs[fname] = rfile
+	return rfile
+}
+
+// reopen closes all log files, they are opened again by path on next write.
+func (pout *ProcOutput) reopen() {
+	pout.lk.Lock()
+	defer pout.lk.Unlock()
+	for fname, rfile := range pout.logs {
+		rfile.Close()
+		delete(pout.logs, fname)
+	}
+}
+
+// setForwarders replaces log forwarders on config reload.
+func (pout *ProcOutput) setForwarders(forwarders []*logForwarder) {
+	pout.lk.Lock()
+	defer pout.lk.Unlock()
+	pout.forwarders = forwarders
+}
+
+// setPid sets the pid of the process once it is started.
+func (pout *ProcOutput) setPid(pid int) {
+	pout.lk.Lock()
+	defer pout.lk.Unlock()
+	pout.pid = pid
+}
+
+// setTee copies all further output to wr as well, nil stops copying.
+func (pout *ProcOutput) setTee(wr io.Writer) {
+	pout.lk.Lock()
+	defer pout.lk.Unlock()
+	pout.tee = wr
+}
+
+// capture reads the pipe line by line in background until it is closed.
+func (pout *ProcOutput) capture(stream string, pipe *os.File) {
+	pout.pipes = append(pout.pipes, pipe)
+	pout.readers.Add(1)
+	go func() {
+		defer pout.readers.Done()
+		rd := bufio.NewReaderSize(pipe, 64*1024)
+		for {
+			//a line longer than the buffer is written in pieces
+			line, err := rd.ReadSlice('\n')
+			if len(line) > 0 {
+				pout.writeLine(stream, line)
+			}
+			if nil != err && err != bufio.ErrBufferFull {
+				return
+			}
+		}
+	}()
+}
+
+// drain waits at most timeout for the remaining output after the process exited, then closes the pipes.
+// Pipes may be kept open by children of the process, so never wait forever.
+func (pout *ProcOutput) drain(timeout time.Duration) {
+	done := make(chan bool)
+	go func() {
+		pout.readers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+	for _, pipe := range pout.pipes {
+		pipe.Close()
+	}
+}
+
+func (pout *ProcOutput) writeLine(stream string, line []byte) {
+	pout.lk.Lock()
+	defer pout.lk.Unlock()
+	if nil != pout.tee {
+		pout.tee.Write(line)
+	}
+	pout.detectCrash(line)
+	pout.tail.add(string(line))
+	for _, f := range pout.forwarders {
+		f.forward(stream, pout.pid, line)
+	}
+	formatted := line
+	if pout.jsonFormat {
+		formatted = pout.jsonLine(stream, line)
+	} else {
+		//a long line is written in pieces, only prefix its first piece
+		if pout.timestamps && !pout.midLine[stream] {
+			formatted = append([]byte(time.Now().Format("2006-01-02T15:04:05.000Z07:00")+" "+stream+" "), line...)
+		}
+		pout.midLine[stream] = line[len(line)-1] != '\n'
+	}
+	//followers get lines as written to the log file
+	publishLine(pout.proc, formatted)
+	if pout.closed {
+		return
+	}
+	if rfile := pout.open(stream); nil != rfile {
+		rfile.Write(formatted)
+	}
+}
+
+// jsonLine formats the line as a json object, fields of a line which is a json object already are merged in.
+func (pout *ProcOutput) jsonLine(stream string, line []byte) []byte {
+	line = bytes.TrimRight(line, "\r\n")
+	record := make(map[string]interface{})
+	if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 && trimmed[0] == '{' {
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		dec.UseNumber()
+		if nil != dec.Decode(&record) || dec.More() {
+			record = make(map[string]interface{})
+		}
+	}
+	if len(record) == 0 {
+		record["msg"] = string(line)
+	}
+	//the time logged by the process itself is more accurate
+	if _, ok := record["time"]; !ok {
+		record["time"] = time.Now().Format(time.RFC3339Nano)
+	}
+	record["proc"] = filepath.Base(pout.proc.processName)
+	record["instance"] = pout.instance
+	record["pid"] = pout.pid
+	record["stream"] = stream
+	data, err := json.Marshal(record)
+	if nil != err {
+		data, _ = json.Marshal(map[string]interface{}{"time": time.Now().Format(time.RFC3339Nano), "msg": string(line), "stream": stream})
+	}
+	return append(data, '\n')
+}
+
+// detectCrash starts capturing at the first line matching a crash pattern, until MaxLines or MaxBytes reached.
+func (pout *ProcOutput) detectCrash(line []byte) {
+	if !pout.crashOutput {
+		for _, re := range pout.crashPatterns {
+			if re.Match(line) {
+				pout.crashOutput = true
+				break
+			}
+		}
+		if !pout.crashOutput {
+			return
+		}
+	}
+	if pout.crashTruncated {
+		return
+	}
+	if pout.crashLines >= pout.crash.MaxLines || pout.crashContent.Len()+len(line) > pout.crash.MaxBytes {
+		pout.crashTruncated = true
+		fmt.Fprintf(&pout.crashContent, "...(truncated at %d lines)\n", pout.crashLines)
+		return
+	}
+	pout.crashLines++
+	pout.crashContent.Write(line)
+}
+
+func (pout *ProcOutput) Close() error {
+	pout.lk.Lock()
+	defer pout.lk.Unlock()
+	pout.closed = true
+	//terminate a partial last line, so output of the next run starts on a new line
+	for stream, mid := range pout.midLine {
+		if rfile, ok := pout.logs[pout.fnames[stream]]; ok && mid {
+			rfile.Write([]byte("\n"))
+		}
+	}
+	var err error
+	for fname, rfile := range pout.logs {
+		if cerr := rfile.Close(); nil != cerr {
+			err = cerr
+		}
+		delete(pout.logs, fname)
+	}
+	return err
+}
@@ -1,89 +1,75 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
+	"hash/fnv"
 	"io"
-	"io/ioutil"
-	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/yinqiwen/gotoolkit/iotools"
 )
 
 var listenFile *os.File
 
-type ProcOutput struct {
-	fname        string
-	crashOutput  bool
-	crashContent bytes.Buffer
-	proc         *monitorProc
-	log          *iotools.RotateFile
-}
-
-func (pout *ProcOutput) reopen() {
-	if nil != pout.log {
-		pout.log.Close()
-	}
-	rfile := &iotools.RotateFile{
-		MaxBackupIndex:  2,
-		MaxFileSize:     1024 * 1024 * 1024,
-		SyncBytesPeriod: 64 * 1024,
-	}
-	err := rfile.Open(pout.fname, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0660)
-	if nil != err {
-		glog.Errorf("%v", err)
-		return
-	}
-	pout.log = rfile
+type monitorProc struct {
+	processName    string
+	args           []string
+	procCmd        *exec.Cmd
+	output         *ProcOutput
+	autoRestart    bool
+	cfg            procConfig
+	startTime      time.Time
+	schedule       *cronSchedule
+	jitter         time.Duration
+	nextRestart    time.Time
+	checkFailures  int
+	checkSuccesses int
+	unhealthy      bool
+	stopping       bool
+	stopReason     string
+	stopDetail     string
+	forceKilled    bool
+	oomFile        string //oom_kill counter of the process cgroup
+	oomKills       int64  //oom_kill counter when the process started
+	restarts       int
+	forwarders     []*logForwarder
+	reload         chan bool
+	quit           chan bool
+	lk             sync.Mutex
 }
 
-func (pout *ProcOutput) Write(p []byte) (int, error) {
-	if nil == pout.log {
-		pout.reopen()
-	}
-	if nil == pout.log {
-		return 0, fmt.Errorf("Log file %s not open", pout.fname)
-	}
-	if pout.crashOutput || (len(pout.proc.cfg.Crash.Prefix) > 0 && bytes.HasPrefix(p, []byte(pout.proc.cfg.Crash.Prefix))) {
-		pout.crashOutput = true
-		pout.crashContent.Write(p)
-	}
-	return pout.log.Write(p)
+func (mproc *monitorProc) isRunning() bool {
+	mproc.lk.Lock()
+	defer mproc.lk.Unlock()
+	return mproc.procCmd != nil
 }
 
-func (pout *ProcOutput) Close() error {
-	if nil == pout.log {
-		return nil
-	}
-	err := pout.log.Close()
-	if nil == err {
-		pout.log = nil
-	}
-	return err
+func (mproc *monitorProc) isAutoRestart() bool {
+	mproc.lk.Lock()
+	defer mproc.lk.Unlock()
+	return mproc.autoRestart
 }
 
-type monitorProc struct {
-	processName   string
-	args          []string
-	procCmd       *exec.Cmd
-	output        *ProcOutput
-	autoRestart   bool
-	cfg           procConfig
-	lastCheckTime int64
-	lk            sync.Mutex
+func (mproc *monitorProc) setAutoRestart(v bool) {
+	mproc.lk.Lock()
+	defer mproc.lk.Unlock()
+	mproc.autoRestart = v
 }
 
-func (mproc *monitorProc) isRunning() bool {
+func (mproc *monitorProc) pid() int {
 	mproc.lk.Lock()
 	defer mproc.lk.Unlock()
-	return mproc.procCmd != nil
+	if nil == mproc.procCmd {
+		return -1
+	}
+	return mproc.procCmd.Process.Pid
 }
 
 func (mproc *monitorProc) wait() bool {
@@ -93,27 +79,62 @@ func (mproc *monitorProc) wait() bool {
 	mproc.lk.Lock()
 	cmd := mproc.procCmd
 	output := mproc.output
-	crashFileName := fmt.Sprintf("%s/%s-crash-%d.log", Cfg.LogDir, filepath.Base(mproc.processName), cmd.Process.Pid)
 	mproc.lk.Unlock()
 	cmd.Wait()
-	glog.Infof("Process:%s %v stoped.", mproc.processName, mproc.args)
+	output.drain(time.Second)
 	mproc.lk.Lock()
-	defer mproc.lk.Unlock()
+	if len(mproc.stopReason) > 0 {
+		glog.Infof("Process:%s %v stoped for reason:%s.", mproc.processName, mproc.args, mproc.stopReason)
+	} else {
+		glog.Infof("Process:%s %v stoped with %v.", mproc.processName, mproc.args, cmd.ProcessState)
+	}
 	if cmd == mproc.procCmd {
 		mproc.procCmd = nil
+		mproc.stopping = false
 	}
+	report := mproc.newCrashReport(cmd, output)
+	crashCfg := mproc.cfg.Crash
+	coreCfg := mproc.cfg.CoreDumps
+	routes := mproc.cfg.Notify
+	startTime := mproc.startTime
+	mproc.lk.Unlock()
 
-	if output.crashContent.Len() > 0 {
-		ioutil.WriteFile(crashFileName, output.crashContent.Bytes(), 0666)
-		if len(mproc.cfg.Crash.Command) > 0 {
-			args := mproc.cfg.Crash.Command[1:]
-			for i := 0; i < len(args); i++ {
-				args[i] = strings.Replace(args[i], "${CrashContent}", output.crashContent.String(), -1)
-				args[i] = strings.Replace(args[i], "${HOSTNAME}", os.Getenv("HOSTNAME"), -1)
-			}
-			exec.Command(mproc.cfg.Crash.Command[0], args...).Run()
+	if nil == report {
+		return true
+	}
+	cfg := getConfig()
+	logDir := cfg.LogDir
+	if report.CoreDumped && coreCfg.Enable {
+		status, _ := cmd.ProcessState.Sys().(syscall.WaitStatus)
+		core, err := collectCore(&coreCfg, logDir, mproc.processName, report.Pid, status.Signal(), startTime)
+		if nil != err {
+			glog.Errorf("Failed to collect core file of process:%s for reason:%v", mproc.processName, err)
+		} else {
+			report.CoreFile = core
 		}
 	}
+	notifyCrash := true
+	if len(report.Signature) > 0 {
+		report.Occurrences, notifyCrash = countCrashSignature(report.Signature, time.Duration(crashCfg.DedupWindow)*time.Second)
+	}
+	crashFileName := report.save(logDir)
+	indexCrash(&cfg, report, crashFileName)
+	glog.Errorf("Process:%s exited unexpectedly(%s), crash report saved to %s", mproc.processName, report.Cause, crashFileName)
+	if !notifyCrash {
+		glog.Infof("Suppress notifications of crash signature:%s, occurrences:%d", report.Signature, report.Occurrences)
+		return true
+	}
+	notify(&event{
+		Type:    "crash",
+		Proc:    mproc.processName,
+		Pid:     report.Pid,
+		Message: fmt.Sprintf("Process:%s exited unexpectedly(%s)", mproc.processName, report.Cause),
+		Report:  report,
+		routes:  routes,
+	})
+	if len(report.Crash) > 0 && len(crashCfg.Command) > 0 {
+		runCrashCommand(&crashCfg, report, crashFileName)
+	}
 	return true
 }
 
@@ -121,6 +142,7 @@ func (mproc *monitorProc) kill(wr io.Writer) {
 	if mproc.isRunning() {
 		mproc.lk.Lock()
 		mproc.autoRestart = false
+		mproc.stopReason = "killed"
 		mproc.procCmd.Process.Kill()
 		mproc.lk.Unlock()
 		for {
@@ -137,34 +159,236 @@ func (mproc *monitorProc) kill(wr io.Writer) {
 	}
 }
 
-func (mproc *monitorProc) check(wr io.Writer) bool {
-	if mproc.autoRestart && !mproc.isRunning() {
+// stop sends SIGTERM to the running process and kills it if it is still alive after StopTimeout seconds.
+func (mproc *monitorProc) stop(reason string) {
+	mproc.lk.Lock()
+	if nil == mproc.procCmd || mproc.stopping {
+		mproc.lk.Unlock()
+		return
+	}
+	mproc.stopping = true
+	mproc.stopReason = reason
+	cmd := mproc.procCmd
+	timeout := mproc.cfg.StopTimeout
+	mproc.lk.Unlock()
+	if timeout <= 0 {
+		timeout = 10
+	}
+	exited := func() bool {
+		mproc.lk.Lock()
+		defer mproc.lk.Unlock()
+		return cmd != mproc.procCmd
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	for !exited() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !exited() {
+		glog.Warningf("Process:%s still alive %ds after SIGTERM, kill it.", mproc.processName, timeout)
+		mproc.lk.Lock()
+		if cmd == mproc.procCmd {
+			mproc.forceKilled = true
+			cmd.Process.Kill()
+		}
+		mproc.lk.Unlock()
+	}
+}
+
+// signal sends sig to the process only if it is still the running one with pid.
+func (mproc *monitorProc) signal(pid int, sig os.Signal) {
+	mproc.lk.Lock()
+	defer mproc.lk.Unlock()
+	if nil != mproc.procCmd && mproc.procCmd.Process.Pid == pid {
+		mproc.procCmd.Process.Signal(sig)
+	}
+}
+
+// restartDue returns a non empty description if the running process reached its MaxUptime or RestartSchedule.
+func (mproc *monitorProc) restartDue(now time.Time) string {
+	mproc.lk.Lock()
+	defer mproc.lk.Unlock()
+	if nil == mproc.procCmd || mproc.stopping {
+		return ""
+	}
+	maxUptime := time.Duration(mproc.cfg.MaxUptime) * time.Second
+	if maxUptime > 0 && now.Sub(mproc.startTime) >= maxUptime+mproc.jitter {
+		return fmt.Sprintf("uptime exceeded %v", maxUptime)
+	}
+	if !mproc.nextRestart.IsZero() && !now.Before(mproc.nextRestart) {
+		return fmt.Sprintf("restart schedule '%s'", mproc.cfg.RestartSchedule)
+	}
+	return ""
+}
+
+func (mproc *monitorProc) checkPeriod() time.Duration {
+	mproc.lk.Lock()
+	defer mproc.lk.Unlock()
+	if mproc.cfg.Check.Period <= 0 {
+		return time.Second
+	}
+	return time.Duration(mproc.cfg.Check.Period) * time.Second
+}
+
+// checkTarget returns the check config and target to check, or nil if nothing to check now.
+func (mproc *monitorProc) checkTarget() (*checkConfig, *checkTarget) {
+	mproc.lk.Lock()
+	defer mproc.lk.Unlock()
+	if nil == mproc.procCmd || mproc.stopping || !mproc.cfg.Check.enabled() {
+		return nil, nil
+	}
+	cfg := mproc.cfg.Check
+	return &cfg, &checkTarget{pid: mproc.procCmd.Process.Pid, name: filepath.Base(mproc.processName)}
+}
+
+// tick restarts the process if it died, and stops it if a scheduled restart is due.
+func (mproc *monitorProc) tick() bool {
+	if mproc.isAutoRestart() && !mproc.isRunning() {
 		mproc.start(&LogWriter{})
 		return true
 	}
-	if !mproc.isRunning() && !mproc.autoRestart {
+	if detail := mproc.restartDue(time.Now()); len(detail) > 0 {
+		glog.Infof("Restart process:%s for reason:scheduled (%s)", mproc.processName, detail)
+		go mproc.stop("scheduled")
+	}
+	return false
+}
+
+type checkOutcome struct {
+	target *checkTarget
+	err    error
+}
+
+// supervise owns the restart and health check timers of the process until it is removed from config.
+func (mproc *monitorProc) supervise() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	checkTimer := time.NewTimer(mproc.checkPeriod())
+	defer checkTimer.Stop()
+	results := make(chan checkOutcome, 1)
+	checking := false
+	if mproc.tick() {
+		dumpPids()
+	}
+	for {
+		select {
+		case <-mproc.quit:
+			mproc.setAutoRestart(false)
+			mproc.stop("removed")
+			dumpPids()
+			return
+		case <-mproc.reload:
+			if !checking {
+				if !checkTimer.Stop() {
+					select {
+					case <-checkTimer.C:
+					default:
+					}
+				}
+				checkTimer.Reset(mproc.checkPeriod())
+			}
+		case <-ticker.C:
+			if mproc.tick() {
+				dumpPids()
+			}
+		case <-checkTimer.C:
+			cfg, target := mproc.checkTarget()
+			if nil == target {
+				checkTimer.Reset(mproc.checkPeriod())
+				continue
+			}
+			//run the check aside, so that a hung check never delays restarts
+			checking = true
+			go func() {
+				results <- checkOutcome{target, runCheck(cfg, target)}
+			}()
+		case res := <-results:
+			checking = false
+			if mproc.checkResult(res.target, res.err) {
+				dumpPids()
+			}
+			checkTimer.Reset(mproc.checkPeriod())
+		}
+	}
+}
+
+// checkResult counts consecutive check results and takes the configured action once the process turns unhealthy.
+func (mproc *monitorProc) checkResult(target *checkTarget, err error) bool {
+	mproc.lk.Lock()
+	defer mproc.lk.Unlock()
+	if nil == mproc.procCmd || mproc.procCmd.Process.Pid != target.pid {
+		//process restarted while checking
 		return false
 	}
-	if len(mproc.cfg.Check.Addr) == 0 {
+	cfg := &mproc.cfg.Check
+	if nil == err {
+		mproc.checkFailures = 0
+		mproc.checkSuccesses++
+		if mproc.unhealthy && mproc.checkSuccesses >= cfg.SuccessThreshold {
+			mproc.unhealthy = false
+			glog.Infof("Process:%s is healthy again after %d successful %s checks.", mproc.processName, mproc.checkSuccesses, cfg.kind())
+		}
 		return false
 	}
-	now := time.Now().Unix()
-	if mproc.lastCheckTime == 0 {
-		mproc.lastCheckTime = now
+	mproc.checkSuccesses = 0
+	mproc.checkFailures++
+	glog.Warningf("Process:%s %s check failed(%d/%d) by reason:%v", mproc.processName, cfg.kind(), mproc.checkFailures, cfg.FailureThreshold, err)
+	if mproc.unhealthy || mproc.checkFailures < cfg.FailureThreshold {
+		return false
 	}
-	if now-mproc.lastCheckTime >= int64(mproc.cfg.Check.Period) {
-		mproc.lastCheckTime = now
-		c, err := net.DialTimeout("tcp", mproc.cfg.Check.Addr, time.Duration(mproc.cfg.Check.Timeout)*time.Second)
-		if nil != err {
-			mproc.procCmd.Process.Kill()
-			glog.Errorf("Kill process:%s since check failed by reason:%v", mproc.processName, err)
-			return true
+	mproc.unhealthy = true
+	notify(&event{
+		Type:    "health-fail",
+		Proc:    mproc.processName,
+		Pid:     target.pid,
+		Message: fmt.Sprintf("%s check failed %d times by reason:%v", cfg.kind(), mproc.checkFailures, err),
+		routes:  mproc.cfg.Notify,
+	})
+	switch strings.ToLower(cfg.Action) {
+	case "", "restart":
+		mproc.stopReason = "health check"
+		mproc.stopDetail = fmt.Sprintf("%s check failed:%v", cfg.kind(), err)
+		if cfg.OnUnhealthy.enabled() {
+			//stop further checks and scheduled restarts while collecting diagnostics
+			mproc.stopping = true
+			go func(cfg checkConfig, output *ProcOutput) {
+				mproc.diagnose(&cfg.OnUnhealthy, target, output, err)
+				mproc.signal(target.pid, syscall.SIGKILL)
+				glog.Errorf("Kill process:%s since %s check failed by reason:%v", mproc.processName, cfg.kind(), err)
+			}(*cfg, mproc.output)
+			return false
+		}
+		mproc.procCmd.Process.Kill()
+		glog.Errorf("Kill process:%s since %s check failed by reason:%v", mproc.processName, cfg.kind(), err)
+		return true
+	case "signal":
+		sig, serr := parseSignal(cfg.Signal)
+		if nil != serr {
+			glog.Errorf("Failed to signal unhealthy process:%s for reason:%v", mproc.processName, serr)
+			return false
 		}
-		c.Close()
+		mproc.procCmd.Process.Signal(sig)
+		glog.Errorf("Send %s to process:%s since %s check failed by reason:%v", cfg.Signal, mproc.processName, cfg.kind(), err)
+	case "command":
+		glog.Errorf("Run %v for process:%s since %s check failed by reason:%v", cfg.ActionCommand, mproc.processName, cfg.kind(), err)
+		go runActionCommand(cfg, target, err)
+	case "alert":
+		glog.Errorf("Process:%s is unhealthy since %s check failed by reason:%v", mproc.processName, cfg.kind(), err)
+	default:
+		glog.Errorf("Unknown check action '%s' for unhealthy process:%s", cfg.Action, mproc.processName)
 	}
 	return false
 }
 
+func (mproc *monitorProc) scheduleRestart(from time.Time) {
+	mproc.nextRestart = time.Time{}
+	if nil != mproc.schedule {
+		if next := mproc.schedule.next(from); !next.IsZero() {
+			mproc.nextRestart = next.Add(mproc.jitter)
+		}
+	}
+}
+
 func (mproc *monitorProc) start(wr io.Writer) {
 	if mproc.isRunning() {
 		io.WriteString(wr, fmt.Sprintf("Process:%s already started.\r\n", mproc.processName))
@@ -175,37 +399,75 @@ func (mproc *monitorProc) start(wr io.Writer) {
 	defer mproc.lk.Unlock()
 	mproc.procCmd = exec.Command(mproc.processName, mproc.args...)
 	mproc.procCmd.Env = append(os.Environ(), mproc.cfg.Env...)
+	if coreCfg := mproc.cfg.CoreDumps; coreCfg.Enable && len(coreCfg.Dir) > 0 {
+		//the kernel writes cores of a relative core_pattern in the working directory of the process
+		os.MkdirAll(coreCfg.Dir, 0770)
+		if path, aerr := filepath.Abs(mproc.procCmd.Path); nil == aerr {
+			mproc.procCmd.Path = path
+		}
+		mproc.procCmd.Dir = coreCfg.Dir
+	}
 
-	var stderrpipe, stdoutpipe io.ReadCloser
-	stderrpipe, err = mproc.procCmd.StderrPipe()
+	if nil != mproc.output {
+		mproc.output.Close()
+	}
+	mproc.output = newProcOutput(mproc, &mproc.cfg)
+	var pipes []*os.File
+	//use our own pipes instead of StdoutPipe, so that cmd.Wait never closes them before all output read
+	for _, stream := range []string{"stdout", "stderr"} {
+		r, w, perr := os.Pipe()
+		if nil != perr {
+			err = perr
+			break
+		}
+		mproc.output.capture(stream, r)
+		pipes = append(pipes, w)
+	}
 	if nil == err {
-		stdoutpipe, err = mproc.procCmd.StdoutPipe()
+		mproc.procCmd.Stdout = pipes[0]
+		mproc.procCmd.Stderr = pipes[1]
+		if mproc.cfg.CoreDumps.Enable {
+			err = startWithCoreLimit(mproc.procCmd)
+		} else {
+			err = startCommand(mproc.procCmd)
+		}
+	}
+	for _, w := range pipes {
+		w.Close()
 	}
-	if nil != err {
-		glog.Errorf("%v", err)
-	} else {
-		if nil != mproc.output {
-			mproc.output.Close()
-		}
-		mproc.output = &ProcOutput{}
-		mproc.output.fname = mproc.cfg.LogFile
-		mproc.output.proc = mproc
-		go func() {
-			io.Copy(mproc.output, stderrpipe)
-		}()
-		go func() {
-			io.Copy(mproc.output, stdoutpipe)
-		}()
-	}
-	err = mproc.procCmd.Start()
 	if err != nil {
 		mproc.procCmd = nil
+		mproc.output.drain(0)
 		io.WriteString(wr, fmt.Sprintf("Failed to start process:%s for reason:%v\r\n", mproc.processName, err))
 		return
 	}
 
 	io.WriteString(wr, fmt.Sprintf("Start process:%s %v success.\r\n", mproc.processName, mproc.args))
+	mproc.output.setPid(mproc.procCmd.Process.Pid)
+	mproc.oomFile = oomKillFile(mproc.procCmd.Process.Pid)
+	mproc.oomKills = oomKillCount(mproc.oomFile)
 	mproc.autoRestart = true
+	if !mproc.startTime.IsZero() {
+		mproc.restarts++
+	}
+	mproc.startTime = time.Now()
+	mproc.checkFailures = 0
+	mproc.checkSuccesses = 0
+	mproc.unhealthy = false
+	mproc.stopping = false
+	mproc.stopReason = ""
+	mproc.stopDetail = ""
+	mproc.forceKilled = false
+	mproc.scheduleRestart(mproc.startTime)
+	if mproc.restarts > 0 {
+		notify(&event{
+			Type:    "restart",
+			Proc:    mproc.processName,
+			Pid:     mproc.procCmd.Process.Pid,
+			Message: fmt.Sprintf("Process:%s %v restarted, restarts:%d", mproc.processName, mproc.args, mproc.restarts),
+			routes:  mproc.cfg.Notify,
+		})
+	}
 	go mproc.wait()
 }
 
@@ -222,13 +484,16 @@ func newMonitorProcTable() *monitorProcTable {
 	return mp
 }
 
-func buildMonitorProcs() {
+func buildMonitorProcs(cfg *procMonConfig) {
 	procTable.mlk.Lock()
-	if Cfg.MaxBackupFile == 0 {
-		Cfg.MaxBackupFile = 10
-	}
-	for _, proc := range Cfg.Monitor {
+	defer procTable.mlk.Unlock()
+	configured := make(map[string]bool)
+	for _, proc := range cfg.Monitor {
 		cmd := strings.Fields(proc.Proc)
+		if len(cmd) == 0 {
+			continue
+		}
+		configured[proc.Proc] = true
 		mproc, ok := procTable.monitorProcs[proc.Proc]
 		//procTable.procNames = append(procTable.procNames, cmd[0])
 		if !ok {
@@ -236,17 +501,107 @@ func buildMonitorProcs() {
 			mproc.processName = cmd[0]
 			mproc.args = cmd[1:]
 			mproc.autoRestart = true
+			mproc.reload = make(chan bool, 1)
+			mproc.quit = make(chan bool)
 			procTable.monitorProcs[proc.Proc] = mproc
 		}
+		if len(proc.LogFile) == 0 {
+			proc.LogFile = filepath.Base(mproc.processName) + ".out"
+		}
+		if !strings.HasPrefix(proc.LogFile, "/") {
+			proc.LogFile = cfg.LogDir + "/" + proc.LogFile
+		}
+		if len(proc.StdoutFile) > 0 && !strings.HasPrefix(proc.StdoutFile, "/") {
+			proc.StdoutFile = cfg.LogDir + "/" + proc.StdoutFile
+		}
+		if len(proc.StderrFile) > 0 && !strings.HasPrefix(proc.StderrFile, "/") {
+			proc.StderrFile = cfg.LogDir + "/" + proc.StderrFile
+		}
+		if proc.Log.MaxSize == 0 {
+			proc.Log.MaxSize = 1024
+		}
+		if proc.Log.MaxBackups == 0 {
+			proc.Log.MaxBackups = 2
+		}
+		if proc.Crash.DedupWindow == 0 {
+			proc.Crash.DedupWindow = 600
+		}
+		if proc.Crash.TailLines <= 0 {
+			proc.Crash.TailLines = 100
+		}
+		if proc.CoreDumps.MaxCount <= 0 {
+			proc.CoreDumps.MaxCount = 3
+		}
+		if proc.Check.Timeout <= 0 {
+			proc.Check.Timeout = 5
+		}
+		if proc.Check.FailureThreshold <= 0 {
+			proc.Check.FailureThreshold = 1
+		}
+		if proc.Check.SuccessThreshold <= 0 {
+			proc.Check.SuccessThreshold = 1
+		}
+		var schedule *cronSchedule
+		if len(proc.RestartSchedule) > 0 {
+			var err error
+			schedule, err = parseCronSchedule(proc.RestartSchedule)
+			if nil != err {
+				glog.Errorf("Invalid RestartSchedule for process:%s for reason:%v", proc.Proc, err)
+			} else if schedule.next(time.Now()).IsZero() {
+				glog.Errorf("RestartSchedule '%s' of process:%s never fires within 5 years", proc.RestartSchedule, proc.Proc)
+				schedule = nil
+			}
+		}
+		mproc.lk.Lock()
+		if !reflect.DeepEqual(mproc.cfg.Forward, proc.Forward) {
+			for _, f := range mproc.forwarders {
+				f.close()
+			}
+			mproc.forwarders = newLogForwarders(proc.Forward, mproc.processName)
+			if nil != mproc.output {
+				mproc.output.setForwarders(mproc.forwarders)
+			}
+		}
 		mproc.cfg = proc
-		if len(mproc.cfg.LogFile) == 0 {
-			mproc.cfg.LogFile = filepath.Base(mproc.processName) + ".out"
+		mproc.schedule = schedule
+		mproc.jitter = restartJitter(proc.Proc, proc.RestartJitter)
+		if nil != mproc.procCmd {
+			mproc.scheduleRestart(time.Now())
 		}
-		if !strings.HasPrefix(mproc.cfg.LogFile, "/") {
-			mproc.cfg.LogFile = Cfg.LogDir + "/" + mproc.cfg.LogFile
+		mproc.lk.Unlock()
+		if ok {
+			select {
+			case mproc.reload <- true:
+			default:
+			}
+		} else {
+			go mproc.supervise()
+		}
+	}
+	for key, mproc := range procTable.monitorProcs {
+		if !configured[key] {
+			glog.Infof("Process:%s removed from config, stop monitoring it.", key)
+			delete(procTable.monitorProcs, key)
+			close(mproc.quit)
+			mproc.lk.Lock()
+			for _, f := range mproc.forwarders {
+				f.close()
+			}
+			mproc.forwarders = nil
+			mproc.lk.Unlock()
 		}
 	}
-	procTable.mlk.Unlock()
+}
+
+// restartJitter spreads scheduled restarts of the same process over different hosts.
+func restartJitter(proc string, maxJitter int) time.Duration {
+	if maxJitter <= 0 {
+		return 0
+	}
+	hostname, _ := os.Hostname()
+	h := fnv.New32a()
+	io.WriteString(h, hostname+"/"+proc)
+	return time.Duration(h.Sum32()%uint32(maxJitter)) * time.Second
 }
 
 func getService(proc string) *monitorProc {
@@ -258,6 +613,29 @@ func getService(proc string) *monitorProc {
 	return nil
 }
 
+// reopenLogs reopens output files of the process.
+func (mproc *monitorProc) reopenLogs() {
+	mproc.lk.Lock()
+	output := mproc.output
+	mproc.lk.Unlock()
+	if nil != output {
+		output.reopen()
+	}
+}
+
+// reopenAllLogs reopens output files of all processes, the audit log and logs of pmond itself.
+// glog can't reopen its own files, so logs of pmond are reopened only if they are written to -log_file.
+func reopenAllLogs() {
+	for _, mproc := range getProcListByName("") {
+		mproc.reopenLogs()
+	}
+	reopenAudit()
+	glog.Flush()
+	if err := reopenLogFile(); nil != err {
+		glog.Errorf("Failed to reopen log file:%s for reason:%v", logFile, err)
+	}
+}
+
 func getProcListByName(name string) []*monitorProc {
 	var procs []*monitorProc
 	procTable.mlk.Lock()
@@ -270,15 +648,27 @@ func getProcListByName(name string) []*monitorProc {
 	return procs
 }
 
+// matchProcs returns processes whose Proc or executable name starts with name, e.g. myapp matches "./myapp -v".
+func matchProcs(name string) []*monitorProc {
+	var procs []*monitorProc
+	procTable.mlk.Lock()
+	defer procTable.mlk.Unlock()
+	for k, proc := range procTable.monitorProcs {
+		if strings.HasPrefix(k, name) || strings.HasPrefix(filepath.Base(proc.processName), name) {
+			procs = append(procs, proc)
+		}
+	}
+	return procs
+}
+
 func listProcs(wr io.Writer) {
 	procTable.mlk.Lock()
 	defer procTable.mlk.Unlock()
 	wr.Write([]byte("PID   Process	Args		Status\r\n"))
 	for _, mproc := range procTable.monitorProcs {
-		pid := -1
+		pid := mproc.pid()
 		status := "stoped"
-		if mproc.isRunning() {
-			pid = mproc.procCmd.Process.Pid
+		if pid > 0 {
 			status = "running"
 		}
 		io.WriteString(wr, fmt.Sprintf("%d   %s	%v		%s\r\n", pid, mproc.processName, mproc.args, status))
@@ -286,6 +676,7 @@ func listProcs(wr io.Writer) {
 }
 
 var pidFile string = ".pids"
+var pidFileLock sync.Mutex
 
 func killAll(wr io.Writer) {
 	for _, mproc := range procTable.monitorProcs {
@@ -297,6 +688,8 @@ func killAll(wr io.Writer) {
 }
 
 func dumpPids() {
+	pidFileLock.Lock()
+	defer pidFileLock.Unlock()
 	file, err := os.Create(pidFile)
 	if nil != err {
 		glog.Error(err)
@@ -307,8 +700,8 @@ func dumpPids() {
 	procTable.mlk.Lock()
 	defer procTable.mlk.Unlock()
 	for _, mproc := range procTable.monitorProcs {
-		if mproc.isRunning() {
-			fmt.Fprintf(file, "%d\n", mproc.procCmd.Process.Pid)
+		if pid := mproc.pid(); pid > 0 {
+			fmt.Fprintf(file, "%d\n", pid)
 		}
 	}
 }
@@ -337,7 +730,7 @@ func restartSelf(wr io.Writer) {
 	cmd.Stderr = os.Stderr
 	cmd.ExtraFiles = []*os.File{listenFile}
 
-	err := cmd.Start()
+	err := startCommand(cmd)
 	if err != nil {
 		glog.Fatalf("gracefulRestart: Failed to launch, error: %v", err)
 	}
@@ -345,26 +738,4 @@ func restartSelf(wr io.Writer) {
 
 func init() {
 	procTable = newMonitorProcTable()
-	routine := func() {
-		dumpPids()
-		checkTickChan := time.NewTicker(time.Millisecond * 1000).C
-		for {
-			select {
-			case <-checkTickChan:
-				changed := false
-				for _, procCfg := range Cfg.Monitor {
-					mproc := getService(procCfg.Proc)
-					if nil != mproc {
-						if mproc.check(&LogWriter{}) {
-							changed = true
-						}
-					}
-				}
-				if changed {
-					dumpPids()
-				}
-			}
-		}
-	}
-	go routine()
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// rotateTimeFormat is the timestamp suffix of rotated files, it sorts in time order.
+const rotateTimeFormat = "20060102-150405"
+
+var rotatedSuffix = regexp.MustCompile(`^\.(\d{8}-\d{6})(?:\.(\d+))?(\.gz)?$`)
+
+// rotateLock serializes compressing and cleaning of rotated files.
+var rotateLock sync.Mutex
+
+// rotateFile is a log file rotated by size and time, rotated files are renamed to <path>.<start time>[.gz].
+// It is not safe for concurrent use.
+type rotateFile struct {
+	path   string
+	cfg    logConfig
+	file   *os.File
+	size   int64
+	opened time.Time
+	next   time.Time
+	check  time.Time //last time the path is checked
+}
+
+func openRotateFile(path string, cfg *logConfig) (*rotateFile, error) {
+	r := &rotateFile{path: path, cfg: *cfg}
+	if err := r.open(); nil != err {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotateFile) open() error {
+	os.MkdirAll(filepath.Dir(r.path), 0770)
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if nil != err {
+		return err
+	}
+	st, err := f.Stat()
+	if nil != err {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = st.Size()
+	r.opened = time.Now()
+	if r.size > 0 {
+		//content of an existing file may belong to an earlier period
+		r.opened = st.ModTime()
+	}
+	r.next = r.periodEnd(r.opened)
+	r.check = time.Now()
+	return nil
+}
+
+// reopen closes and opens the file by path again, e.g. after it is moved by logrotate.
+func (r *rotateFile) reopen() error {
+	if nil != r.file {
+		r.file.Close()
+		r.file = nil
+	}
+	return r.open()
+}
+
+// moved returns true if the path no longer refers to the opened file, it checks at most once a second.
+// It also updates the size, the file may be truncated by others, e.g. logrotate with copytruncate.
+func (r *rotateFile) moved() bool {
+	now := time.Now()
+	if now.Sub(r.check) < time.Second {
+		return false
+	}
+	r.check = now
+	st, err := r.file.Stat()
+	if nil != err {
+		return true
+	}
+	r.size = st.Size()
+	pst, err := os.Stat(r.path)
+	return nil != err || !os.SameFile(st, pst)
+}
+
+// periodEnd returns the time the file opened at t should be rotated, zero time if no time based rotation.
+func (r *rotateFile) periodEnd(t time.Time) time.Time {
+	switch strings.ToLower(r.cfg.Rotate) {
+	case "hourly":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+	case "daily":
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Time{}
+}
+
+func (r *rotateFile) Write(p []byte) (int, error) {
+	if nil == r.file {
+		//a former reopen failed
+		if err := r.open(); nil != err {
+			return 0, err
+		}
+	}
+	if r.moved() {
+		glog.Infof("Log file:%s moved or removed, reopen it.", r.path)
+		if err := r.reopen(); nil != err {
+			return 0, err
+		}
+	}
+	if r.size > 0 && ((r.cfg.MaxSize > 0 && r.size+int64(len(p)) > int64(r.cfg.MaxSize)*1024*1024) ||
+		(!r.next.IsZero() && !time.Now().Before(r.next))) {
+		if err := r.rotate(); nil != err {
+			glog.Errorf("Failed to rotate log file:%s for reason:%v", r.path, err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file with its start time, then opens a new one.
+func (r *rotateFile) rotate() error {
+	r.file.Close()
+	r.file = nil
+	base := r.path + "." + r.opened.Format(rotateTimeFormat)
+	rotated := base
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			if _, err = os.Stat(rotated + ".gz"); os.IsNotExist(err) {
+				break
+			}
+		}
+		rotated = fmt.Sprintf("%s.%d", base, i)
+	}
+	err := os.Rename(r.path, rotated)
+	if oerr := r.open(); nil != oerr {
+		return oerr
+	}
+	if nil != err {
+		return err
+	}
+	cfg := r.cfg
+	path := r.path
+	//compressing a big file may take a while, never block the writer
+	go func() {
+		rotateLock.Lock()
+		defer rotateLock.Unlock()
+		if cfg.Compress {
+			if err := gzipFile(rotated, rotated+".gz"); nil != err {
+				glog.Errorf("Failed to compress rotated log file:%s for reason:%v", rotated, err)
+			}
+		}
+		cleanRotatedFiles(path, &cfg)
+	}()
+	return nil
+}
+
+func (r *rotateFile) Close() error {
+	if nil == r.file {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// rotatedFiles returns the rotated files of path, oldest first.
+// Files rotated in the same second are ordered by their numeric suffix, e.g. .2 before .10.
+func rotatedFiles(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	type rotated struct {
+		file  string
+		start string
+		n     int
+	}
+	var files []rotated
+	for _, file := range matches {
+		if m := rotatedSuffix.FindStringSubmatch(file[len(path):]); nil != m {
+			n, _ := strconv.Atoi(m[2])
+			files = append(files, rotated{file, m[1], n})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].start != files[j].start {
+			return files[i].start < files[j].start
+		}
+		return files[i].n < files[j].n
+	})
+	names := make([]string, len(files))
+	for i := range files {
+		names[i] = files[i].file
+	}
+	return names
+}
+
+// cleanRotatedFiles keeps at most MaxBackups rotated files, and MaxTotalSize MB including the current file.
+func cleanRotatedFiles(path string, cfg *logConfig) {
+	var total int64
+	if st, err := os.Stat(path); nil == err {
+		total = st.Size()
+	}
+	files := rotatedFiles(path)
+	for i := len(files) - 1; i >= 0; i-- {
+		st, err := os.Stat(files[i])
+		if nil != err {
+			continue
+		}
+		total += st.Size()
+		kept := len(files) - i
+		if (cfg.MaxBackups > 0 && kept > cfg.MaxBackups) || (cfg.MaxTotalSize > 0 && total > int64(cfg.MaxTotalSize)*1024*1024) {
+			if err = os.Remove(files[i]); nil != err {
+				glog.Errorf("Failed to remove rotated log file:%s for reason:%v", files[i], err)
+			}
+		}
+	}
+}
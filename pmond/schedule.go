@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron style spec: "minute hour day-of-month month day-of-week".
+type cronSchedule struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	domAny bool
+	dowAny bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			n, err := strconv.Atoi(part[idx+1:])
+			if nil != err || n <= 0 {
+				return 0, fmt.Errorf("Invalid step in '%s'", part)
+			}
+			step = n
+			part = part[:idx]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); nil != err {
+				return 0, fmt.Errorf("Invalid value '%s'", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); nil != err {
+					return 0, fmt.Errorf("Invalid range '%s'", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("Value '%s' out of range [%d,%d]", part, min, max)
+		}
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Invalid cron spec '%s', expected 5 fields", spec)
+	}
+	sched := new(cronSchedule)
+	var err error
+	if sched.minute, err = parseCronField(fields[0], 0, 59); nil != err {
+		return nil, err
+	}
+	if sched.hour, err = parseCronField(fields[1], 0, 23); nil != err {
+		return nil, err
+	}
+	if sched.dom, err = parseCronField(fields[2], 1, 31); nil != err {
+		return nil, err
+	}
+	if sched.month, err = parseCronField(fields[3], 1, 12); nil != err {
+		return nil, err
+	}
+	if sched.dow, err = parseCronField(fields[4], 0, 7); nil != err {
+		return nil, err
+	}
+	//both 0 and 7 mean sunday
+	if sched.dow&(1<<7) != 0 {
+		sched.dow |= 1
+	}
+	sched.domAny = fields[2] == "*"
+	sched.dowAny = fields[4] == "*"
+	return sched, nil
+}
+
+func (sched *cronSchedule) dayMatch(t time.Time) bool {
+	domMatch := sched.dom&(1<<uint(t.Day())) != 0
+	dowMatch := sched.dow&(1<<uint(t.Weekday())) != 0
+	//same as cron: if both day fields are restricted, either one may match
+	if !sched.domAny && !sched.dowAny {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// next returns the first matching minute strictly after t, or zero time if none within 5 years.
+func (sched *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if sched.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !sched.dayMatch(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if sched.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if sched.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// redirectStderr points stderr of pmond to the file, dup2 is missing on some linux archs like arm64.
+func redirectStderr(f *os.File) error {
+	return syscall.Dup3(int(f.Fd()), int(os.Stderr.Fd()), 0)
+}
@@ -0,0 +1,13 @@
+//go:build unix && !linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// redirectStderr points stderr of pmond to the file.
+func redirectStderr(f *os.File) error {
+	return syscall.Dup2(int(f.Fd()), int(os.Stderr.Fd()))
+}
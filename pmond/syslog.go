@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// syslog severities
+const (
+	sevCrit    = 2
+	sevErr     = 3
+	sevWarning = 4
+	sevNotice  = 5
+	sevInfo    = 6
+)
+
+func parseFacility(name string) (int, error) {
+	if len(name) == 0 {
+		return syslogFacilities["daemon"], nil
+	}
+	if f, ok := syslogFacilities[strings.ToLower(name)]; ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf("Unknown syslog facility '%s'", name)
+}
+
+// formatRFC5424 formats a syslog message without structured data.
+func formatRFC5424(facility, severity int, t time.Time, host, app string, pid int, msgid, msg string) []byte {
+	procid := "-"
+	if pid > 0 {
+		procid = fmt.Sprintf("%d", pid)
+	}
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %s %s - %s", facility*8+severity,
+		t.Format("2006-01-02T15:04:05.000000Z07:00"), syslogField(host), syslogField(app), procid, syslogField(msgid), msg))
+}
+
+// formatRFC3164 formats a syslog message in the legacy BSD format.
+func formatRFC3164(facility, severity int, t time.Time, host, tag string, pid int, msg string) []byte {
+	if pid > 0 {
+		tag = fmt.Sprintf("%s[%d]", tag, pid)
+	}
+	return []byte(fmt.Sprintf("<%d>%s %s %s: %s", facility*8+severity, t.Format(time.Stamp), syslogField(host), tag, msg))
+}
+
+// syslogField returns the NILVALUE for empty header fields, spaces are not allowed in them.
+func syslogField(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return strings.Replace(s, " ", "_", -1)
+}
+
+// syslogWriter writes messages to a local or remote syslog server, it reconnects on failure.
+type syslogWriter struct {
+	network string
+	addr    string
+	timeout time.Duration
+	conn    net.Conn
+	lk      sync.Mutex
+}
+
+func newSyslogWriter(network, addr string, timeout time.Duration) *syslogWriter {
+	if len(network) == 0 {
+		network = "unix"
+	}
+	if len(addr) == 0 && strings.HasPrefix(network, "unix") {
+		addr = "/dev/log"
+	}
+	return &syslogWriter{network: network, addr: addr, timeout: timeout}
+}
+
+func (w *syslogWriter) connect() (err error) {
+	if w.network == "unix" {
+		//the local syslog socket is usually a datagram socket
+		if w.conn, err = net.DialTimeout("unixgram", w.addr, w.timeout); nil == err {
+			return nil
+		}
+	}
+	w.conn, err = net.DialTimeout(w.network, w.addr, w.timeout)
+	return err
+}
+
+func (w *syslogWriter) writeMsg(msg []byte) error {
+	if nil == w.conn {
+		if err := w.connect(); nil != err {
+			return err
+		}
+	}
+	switch w.conn.RemoteAddr().Network() {
+	case "tcp":
+		//octet counting framing of RFC 6587
+		msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	case "unix":
+		msg = append(msg, '\n')
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	_, err := w.conn.Write(msg)
+	return err
+}
+
+// write sends one message, it retries once with a new connection if the old one is broken.
+func (w *syslogWriter) write(msg []byte) error {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	err := w.writeMsg(msg)
+	if nil != err && nil != w.conn {
+		w.conn.Close()
+		w.conn = nil
+		err = w.writeMsg(msg)
+	}
+	return err
+}
+
+func (w *syslogWriter) Close() error {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	if nil != w.conn {
+		w.conn.Close()
+		w.conn = nil
+	}
+	return nil
+}
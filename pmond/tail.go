@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// logFollowers receive output lines of processes for "tail -f".
+var logFollowers = make(map[*monitorProc]map[chan []byte]bool)
+var followLock sync.Mutex
+var followerCount int32
+
+func followLogs(mproc *monitorProc) chan []byte {
+	ch := make(chan []byte, 1024)
+	followLock.Lock()
+	defer followLock.Unlock()
+	if nil == logFollowers[mproc] {
+		logFollowers[mproc] = make(map[chan []byte]bool)
+	}
+	logFollowers[mproc][ch] = true
+	atomic.AddInt32(&followerCount, 1)
+	return ch
+}
+
+func unfollowLogs(mproc *monitorProc, ch chan []byte) {
+	followLock.Lock()
+	defer followLock.Unlock()
+	delete(logFollowers[mproc], ch)
+	if len(logFollowers[mproc]) == 0 {
+		delete(logFollowers, mproc)
+	}
+	atomic.AddInt32(&followerCount, -1)
+}
+
+// publishLine sends the line to followers of the process, lines are dropped for slow followers.
+func publishLine(mproc *monitorProc, line []byte) {
+	if atomic.LoadInt32(&followerCount) == 0 {
+		return
+	}
+	followLock.Lock()
+	defer followLock.Unlock()
+	for ch := range logFollowers[mproc] {
+		select {
+		case ch <- append([]byte(nil), line...):
+		default:
+		}
+	}
+}
+
+// lastLines returns at most n last lines of the file, gzipped files are supported.
+func lastLines(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if nil != err {
+		return nil, err
+	}
+	defer f.Close()
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if nil != err {
+			return nil, err
+		}
+		ring := newLineRing(n)
+		rd := bufio.NewReader(zr)
+		for {
+			line, err := rd.ReadString('\n')
+			if len(line) > 0 {
+				ring.add(strings.TrimRight(line, "\r\n"))
+			}
+			if nil != err {
+				break
+			}
+		}
+		return ring.last(n), nil
+	}
+	st, err := f.Stat()
+	if nil != err {
+		return nil, err
+	}
+	//read backwards until n+1 newlines found, the last byte may be a newline itself
+	var data []byte
+	offset := st.Size()
+	chunk := int64(64 * 1024)
+	for offset > 0 && bytes.Count(data, []byte("\n")) <= n {
+		size := chunk
+		if offset < size {
+			size = offset
+		}
+		offset -= size
+		buf := make([]byte, size)
+		if _, err = f.ReadAt(buf, offset); nil != err && err != io.EOF {
+			return nil, err
+		}
+		data = append(buf, data...)
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], "\r")
+	}
+	return lines, nil
+}
+
+// tailFile returns at most n last lines of the log file and its rotated files.
+func tailFile(path string, n int) ([]string, error) {
+	lines, err := lastLines(path, n)
+	if nil != err && !os.IsNotExist(err) {
+		return nil, err
+	}
+	rotated := rotatedFiles(path)
+	for i := len(rotated) - 1; i >= 0 && len(lines) < n; i-- {
+		older, err := lastLines(rotated[i], n-len(lines))
+		if nil != err {
+			continue
+		}
+		lines = append(older, lines...)
+	}
+	return lines, nil
+}
+
+// logFiles returns distinct output files of the process, stdout first.
+func (mproc *monitorProc) logFiles() []string {
+	mproc.lk.Lock()
+	cfg := mproc.cfg
+	mproc.lk.Unlock()
+	stdout, stderr := cfg.LogFile, cfg.LogFile
+	if len(cfg.StdoutFile) > 0 {
+		stdout = cfg.StdoutFile
+	}
+	if len(cfg.StderrFile) > 0 {
+		stderr = cfg.StderrFile
+	}
+	if stdout == stderr {
+		return []string{stdout}
+	}
+	return []string{stdout, stderr}
+}
+
+// tailLines writes last n lines of the process output, from the in-memory buffer if it is enough.
+// The buffer keeps raw lines, so it is skipped if lines are written with Timestamps or in json LogFormat.
+// With follow it returns a channel of new lines, which must be released by unfollowLogs.
+func (mproc *monitorProc) tailLines(n int, wr io.Writer, follow bool) chan []byte {
+	var ch chan []byte
+	mproc.lk.Lock()
+	output := mproc.output
+	mproc.lk.Unlock()
+	if nil != output && !output.timestamps && !output.jsonFormat {
+		output.lk.Lock()
+		lines := output.tail.last(0)
+		if len(lines) >= n {
+			//lines are published under the output lock, so each line is either in the buffer or sent to ch
+			if follow {
+				ch = followLogs(mproc)
+			}
+			output.lk.Unlock()
+			for _, line := range lines[len(lines)-n:] {
+				io.WriteString(wr, strings.TrimRight(line, "\r\n")+"\r\n")
+			}
+			return ch
+		}
+		output.lk.Unlock()
+	}
+	//subscribe before reading files so no line is missed, a line written meanwhile may be printed twice
+	if follow {
+		ch = followLogs(mproc)
+	}
+	files := mproc.logFiles()
+	for _, file := range files {
+		if len(files) > 1 {
+			fmt.Fprintf(wr, "==> %s <==\r\n", file)
+		}
+		lines, err := tailFile(file, n)
+		if nil != err {
+			fmt.Fprintf(wr, "Failed to read %s for reason:%v\r\n", file, err)
+			continue
+		}
+		for _, line := range lines {
+			io.WriteString(wr, line+"\r\n")
+		}
+	}
+	return ch
+}
+
+// tailLog prints last lines of process output, with -f new lines are streamed until the client disconnects.
+func tailLog(args []string, c io.ReadWriteCloser) bool {
+	n := 10
+	follow := false
+	for _, arg := range args[1:] {
+		if arg == "-f" {
+			follow = true
+		} else if v, err := strconv.Atoi(strings.TrimPrefix(arg, "-")); nil == err && v > 0 {
+			n = v
+		} else {
+			fmt.Fprintf(c, "Invalid tail arg '%s'\r\n", arg)
+			return false
+		}
+	}
+	procs := matchProcs(args[0])
+	if len(procs) == 0 {
+		fmt.Fprintf(c, "No process found by name '%s'\r\n", args[0])
+		return false
+	}
+	var chs []chan []byte
+	for _, proc := range procs {
+		if len(procs) > 1 {
+			fmt.Fprintf(c, "==> %s <==\r\n", proc.processName)
+		}
+		if ch := proc.tailLines(n, c, follow); nil != ch {
+			defer unfollowLogs(proc, ch)
+			chs = append(chs, ch)
+		}
+	}
+	if !follow {
+		return true
+	}
+	done := make(chan bool)
+	go func() {
+		//any input or disconnection of the client stops following
+		c.Read(make([]byte, 1))
+		close(done)
+	}()
+	lines := make(chan []byte, 1024)
+	for i, ch := range chs {
+		prefix := ""
+		if len(procs) > 1 {
+			prefix = procs[i].processName + ": "
+		}
+		go func(ch chan []byte, prefix string) {
+			for {
+				select {
+				case line := <-ch:
+					select {
+					case lines <- append([]byte(prefix), line...):
+					case <-done:
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}(ch, prefix)
+	}
+	for {
+		select {
+		case line := <-lines:
+			line = append(bytes.TrimRight(line, "\r\n"), '\r', '\n')
+			if _, err := c.Write(line); nil != err {
+				return true
+			}
+		case <-done:
+			return true
+		}
+	}
+}